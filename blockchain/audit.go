@@ -0,0 +1,309 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/blockchain-app-go/storage"
+)
+
+// The first block where VerifyChain found the chain to be inconsistent
+type BlockError struct {
+	Height int
+	Hash   []byte
+	Reason string
+}
+
+func (err *BlockError) Error() string {
+	return fmt.Sprintf("Block %d %x: %s", err.Height, err.Hash, err.Reason)
+}
+
+// What VerifyChain checked, a pruned chain only has the headers of its old blocks
+type ChainReport struct {
+	Height      int
+	Blocks      int  // Blocks whose links, height and proof of work were checked
+	FullBlocks  int  // Blocks whose transactions were checked
+	Signatures  int  // Inputs whose signatures were verified
+	UTXOChecked bool // The UTXO set can't be rebuilt on a pruned chain
+}
+
+// Reads the hashes of the chain from the tip down and returns them from the genesis up
+func (chain *Blockchain) chainHashes() ([][]byte, error) {
+	var hashes [][]byte
+	height := -1 // Unknown until the tip is read
+
+	hash := chain.lastHash
+	for {
+		data, err := chain.Database.Get(hash)
+		if err == storage.ErrNotFound {
+			return nil, &BlockError{height, hash, "is missing"}
+		} else if err != nil {
+			return nil, err
+		}
+
+		block, err := Deserialize(data)
+		if err != nil {
+			return nil, &BlockError{height, hash, fmt.Sprintf("cannot be decoded: %s", err)}
+		}
+		if !bytes.Equal(block.Hash, hash) {
+			return nil, &BlockError{block.Height, hash, fmt.Sprintf("is stored with the hash of block %x", block.Hash)}
+		}
+
+		hashes = append([][]byte{hash}, hashes...)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+		hash, height = block.PrevHash, block.Height-1
+	}
+
+	return hashes, nil
+}
+
+/*
+	Builds the previous transactions of the inputs from an in-memory UTXO set, with the outputs in
+	their original positions like UTXOSet.FindTransaction does. Missing outputs are left to the spend
+*/
+func previousFromSet(set map[string]TxOutputs, tx *Transaction) map[string]Transaction {
+	prevTxs := make(map[string]Transaction)
+
+	for _, in := range tx.Inputs {
+		inID := hex.EncodeToString(in.ID)
+		outs, ok := set[inID]
+		if !ok {
+			continue
+		}
+
+		prevTx := Transaction{ID: in.ID}
+		for i, out := range outs.Outputs {
+			for len(prevTx.Outputs) <= outs.Index(i) {
+				prevTx.Outputs = append(prevTx.Outputs, TxOutput{})
+			}
+			prevTx.Outputs[outs.Index(i)] = out
+		}
+		prevTxs[inID] = prevTx
+	}
+
+	return prevTxs
+}
+
+// Checks what can be checked of a block on its own, without the rest of the chain
+func checkBlockData(block *Block) string {
+	if block.IsPruned() {
+		if err := checkProofOfWork(block); err != nil {
+			return "invalid proof of work"
+		}
+		return ""
+	}
+
+	// The transactions are hashed again, the hash of the block is what commits to them
+	if len(block.MerkleRoot) != 0 && !bytes.Equal(block.MerkleRoot, block.HashTransaction()) {
+		return "merkle root doesn't match the transactions"
+	}
+	pow := NewProof(block)
+	hash := pow.Hash()
+	if !bytes.Equal(hash, block.Hash) {
+		return "merkle root of the transactions doesn't match the hash of the block"
+	}
+	if new(big.Int).SetBytes(hash).Cmp(pow.Target) != -1 {
+		return "invalid proof of work"
+	}
+
+	// The ID of a transaction is taken before it is signed, so it can only be checked to be unique
+	coinbases := 0
+	txIDs := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if txIDs[hex.EncodeToString(tx.ID)] {
+			return fmt.Sprintf("transaction %x is included twice", tx.ID)
+		}
+		txIDs[hex.EncodeToString(tx.ID)] = true
+		if !checkDataCarriers(tx) {
+			return fmt.Sprintf("transaction %x has an invalid data-carrier output", tx.ID)
+		}
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+	}
+	if coinbases > 1 {
+		return "more than one coinbase transaction"
+	}
+
+	return ""
+}
+
+/*
+	Audits the whole chain from the genesis to the tip: links, heights, proofs of work, merkle roots
+	and duplicate transactions. The transactions are replayed on a UTXO set in memory to find double spends
+	and the result is compared with the stored UTXO set. Verifying signatures and UTXO commitments
+	is the expensive part, so with depth > 0 it is only done on the last depth blocks. The error of
+	an inconsistent chain is a *BlockError with the first bad block
+*/
+func (chain *Blockchain) VerifyChain(depth int) (*ChainReport, error) {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
+	hashes, err := chain.chainHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	prunedHeight, err := chain.PrunedHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ChainReport{Height: len(hashes) - 1, UTXOChecked: prunedHeight < 0}
+	state := newUTXOState(nil, nil)
+	var prevHash, prevRoot []byte
+
+	for height, hash := range hashes {
+		block, err := chain.GetBlock(hash)
+		if err != nil && err != ErrBlockPruned {
+			return nil, err
+		}
+		fail := func(reason string, args ...interface{}) (*ChainReport, error) {
+			return nil, &BlockError{height, hash, fmt.Sprintf(reason, args...)}
+		}
+
+		if !bytes.Equal(block.PrevHash, prevHash) {
+			return fail("doesn't link to the previous block")
+		}
+		if block.Height != height {
+			return fail("has height %d", block.Height)
+		}
+		if reason := checkBlockData(&block); reason != "" {
+			return fail("%s", reason)
+		}
+		if len(prevRoot) != 0 && len(block.UTXORoot) == 0 {
+			return fail("has no UTXO commitment after a block with one")
+		}
+		if block.IsPruned() && height > prunedHeight {
+			return fail("has no transactions above the pruned height %d", prunedHeight)
+		}
+		prevHash, prevRoot = block.Hash, block.UTXORoot
+		report.Blocks++
+
+		if block.IsPruned() {
+			continue
+		}
+		report.FullBlocks++
+
+		if !report.UTXOChecked {
+			continue
+		}
+
+		deep := depth <= 0 || height > report.Height-depth
+		reason, signatures, err := replayBlock(state, &block, nil, deep)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			return fail("%s", reason)
+		}
+		report.Signatures += signatures
+	}
+
+	if !report.UTXOChecked {
+		return report, nil
+	}
+
+	rebuilt, err := sortedEntries(state.set)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := UTXOSet{chain}.Entries()
+	if err != nil {
+		return nil, err
+	}
+	if txID, ok := firstUTXODifference(rebuilt, stored); !ok {
+		tip := hashes[len(hashes)-1]
+		return nil, &BlockError{report.Height, tip, fmt.Sprintf("stored UTXO set differs from the chain at transaction %x", txID)}
+	}
+
+	return report, nil
+}
+
+/*
+	Replays the transactions of a full block on a UTXO state: the outputs they spend must be in it
+	and the coinbase can't take more than the subsidy and the fees. With verify the signatures and
+	the UTXO commitment are checked too. Returns why the block is invalid, empty when it is valid,
+	and the number of signatures verified. The state is left half way when the block is invalid
+*/
+func replayBlock(state *utxoState, block *Block, cache *SigCache, verify bool) (string, int, error) {
+	var checks []inputCheck
+	fees, minted := 0, 0
+
+	before, err := state.track(touchedEntries(block.Transactions))
+	if err != nil {
+		return "", 0, err
+	}
+	set := state.set
+
+	for _, tx := range block.Transactions {
+		if !checkDataCarriers(tx) {
+			return fmt.Sprintf("transaction %x has an invalid data-carrier output", tx.ID), 0, nil
+		}
+		if !checkOutputValues(tx) {
+			return fmt.Sprintf("transaction %x has an output with no value", tx.ID), 0, nil
+		}
+		if tx.IsCoinbase() {
+			minted += tx.OutputValue()
+		} else {
+			prevTxs := previousFromSet(set, tx)
+			for inIdx, in := range tx.Inputs {
+				if err := spendOutput(set, in); err != nil {
+					return fmt.Sprintf("transaction %x spends an output that is spent or doesn't exist: %s", tx.ID, err), 0, nil
+				}
+				checks = append(checks, inputCheck{tx, inIdx, prevTxs})
+			}
+
+			fee, err := tx.Fee(prevTxs)
+			if err != nil || fee < 0 {
+				return fmt.Sprintf("transaction %x spends more than its inputs", tx.ID), 0, nil
+			}
+			fees += fee
+		}
+		addOutputs(set, tx)
+	}
+
+	if minted > Subsidy+fees {
+		return fmt.Sprintf("coinbase creates %d, more than the subsidy and the fees", minted), 0, nil
+	}
+	if err := state.commit(before); err != nil {
+		return "", 0, err
+	}
+	if !verify {
+		return "", 0, nil
+	}
+
+	if !verifyInputs(checks, cache, false) {
+		return "has an invalid signature", 0, nil
+	}
+	if len(block.UTXORoot) != 0 && !bytes.Equal(state.tree.root(), block.UTXORoot) {
+		return "UTXO commitment doesn't match the UTXO set", 0, nil
+	}
+
+	return "", len(checks), nil
+}
+
+// Compares two sorted UTXO sets, it returns the first transaction whose outputs are not the same
+func firstUTXODifference(a, b []UTXOEntry) ([]byte, bool) {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if i >= len(a) {
+			return b[i].TxID, false
+		}
+		if i >= len(b) {
+			return a[i].TxID, false
+		}
+		if !bytes.Equal(HashUTXOEntries(a[i:i+1]), HashUTXOEntries(b[i:i+1])) {
+			if bytes.Compare(a[i].TxID, b[i].TxID) > 0 {
+				return b[i].TxID, false
+			}
+			return a[i].TxID, false
+		}
+	}
+
+	return nil, true
+}
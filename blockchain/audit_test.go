@@ -0,0 +1,30 @@
+package blockchain
+
+import "testing"
+
+func TestCheckBlockDataHashesTheTransactions(t *testing.T) {
+	w := newTestWallet(t)
+	chain := newTestChain(t, string(w.Address()))
+	block := prepareTestBlock(t, chain, newCoinbase(t, string(w.Address()), 0))
+	if reason := checkBlockData(block); reason != "" {
+		t.Fatalf("Valid block rejected: %s", reason)
+	}
+
+	// A block without its merkle root stored must still be checked against its transactions
+	tampered := *block
+	coinbase := *block.Transactions[0]
+	coinbase.Outputs = append([]TxOutput{}, coinbase.Outputs...)
+	coinbase.Outputs[0].Value += Subsidy
+	tampered.Transactions = []*Transaction{&coinbase}
+	if len(tampered.MerkleRoot) != 0 {
+		t.Fatal("The block stores its merkle root")
+	}
+	if reason := checkBlockData(&tampered); reason != "merkle root of the transactions doesn't match the hash of the block" {
+		t.Fatalf("Tampered transactions gave %q", reason)
+	}
+
+	tampered.MerkleRoot = block.HashTransaction()
+	if reason := checkBlockData(&tampered); reason != "merkle root doesn't match the transactions" {
+		t.Fatalf("Stored merkle root of other transactions gave %q", reason)
+	}
+}
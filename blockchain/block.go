@@ -3,6 +3,7 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"log"
 	"time"
 )
@@ -14,6 +15,8 @@ type Block struct {
 	PrevHash     []byte         // Previous block's hash in the chain
 	Nonce        int
 	Height       int
+	MerkleRoot   []byte // Only set on pruned blocks, which keep the header but not the transactions
+	UTXORoot     []byte // Commitment to the UTXO set after the block, empty on blocks mined before it existed
 }
 
 // Method to provide an unique representation to all the transactions from the block combined
@@ -29,8 +32,46 @@ func (block *Block) HashTransaction() []byte {
 	return tree.RootNode.Data
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height} // create a block with an empty hash
+// The merkle root of a pruned block can't be computed anymore so it is stored in the header
+func (block *Block) MerkleRootHash() []byte {
+	if block.IsPruned() {
+		return block.MerkleRoot
+	}
+
+	return block.HashTransaction()
+}
+
+// Every full block has at least the coinbase transaction, only pruned blocks have none
+func (block *Block) IsPruned() bool {
+	return len(block.Transactions) == 0
+}
+
+// Returns a copy of the block without its transactions, which is enough to check the proof of work
+func (block *Block) Header() *Block {
+	return &Block{block.Timestamp, block.Hash, nil, block.PrevHash, block.Nonce, block.Height, block.MerkleRootHash(), block.UTXORoot}
+}
+
+// Returns the merkle proof that links the transaction with the merkle root of the block
+func (block *Block) TransactionProof(txID []byte) ([]MerkleProofNode, error) {
+	var txHashes [][]byte
+	index := -1
+
+	for i, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+		txHashes = append(txHashes, tx.Serialize())
+	}
+
+	if index == -1 {
+		return nil, errors.New("Transaction is not in the block")
+	}
+
+	return NewMerkleProof(txHashes, index), nil
+}
+
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, utxoRoot []byte) *Block {
+	block := newBlock(txs, prevHash, height, utxoRoot)
 	pow := NewProof(block)
 
 	nonce, hash := pow.Run()
@@ -41,9 +82,18 @@ func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
 	return block
 }
 
+// A block with an empty hash and no proof of work yet
+func newBlock(txs []*Transaction, prevHash []byte, height int, utxoRoot []byte) *Block {
+	return &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height, nil, utxoRoot}
+}
+
 // The Genesis block is the first block of a Blockchain
 func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	txs := []*Transaction{coinbase}
+	state := newUTXOState(nil, nil)
+	HandleError(state.applyTransactions(txs))
+
+	return CreateBlock(txs, []byte{}, 0, state.tree.root())
 }
 
 func (block *Block) Serialize() []byte {
@@ -57,16 +107,18 @@ func (block *Block) Serialize() []byte {
 	return res.Bytes()
 }
 
-func Deserialize(data []byte) *Block {
+func Deserialize(data []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 
-	err := decoder.Decode(&block)
+	if err := decoder.Decode(&block); err != nil {
+		return nil, err
+	}
 
-	HandleError(err)
-	return &block
+	return &block, nil
 }
 
+// Only for errors that can't happen unless there is a bug, like failing to encode a value in memory
 func HandleError(err error) {
 	if err != nil {
 		log.Panic(err)
@@ -2,185 +2,340 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
 	"encoding/hex"
-	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strings"
+	"sync"
 
-	"github.com/dgraph-io/badger"
+	"github.com/blockchain-app-go/datadir"
+	"github.com/blockchain-app-go/storage"
+	"github.com/blockchain-app-go/wallet"
 )
 
 const (
-	dbPath      = "./tmp/blocks_%s" // Track multiple blocks/databases
 	genesisData = "First Transaction from Genesis"
 )
 
+var lastHashKey = []byte("lh") // Hash of the last block of the chain
+
+/*
+	The tip, the blocks and the UTXO set are only changed while holding the write lock, and every
+	block is connected in a single transaction of the store, so they never diverge. The methods
+	reading the chain can be called from any goroutine
+*/
 type Blockchain struct {
-	LastHash []byte
-	Database *badger.DB
+	lastHash []byte
+	Database storage.Store
+	SigCache *SigCache // Signatures already verified, mostly by the memory pool
+	Events   *EventBus // Blocks connected to the chain and changes of the memory pool
+	mutex    sync.RWMutex
+	trees    treeCache // Tree of the UTXO set at the tip, so its commitment isn't rebuilt for every block
 }
 
-func DbExists(path string) bool {
-	if _, err := os.Stat(path + "/MANIFEST"); os.IsNotExist(err) {
-		return false
-	}
-	return true
+func newChain(lastHash []byte, db storage.Store) *Blockchain {
+	return &Blockchain{lastHash: lastHash, Database: db, SigCache: NewSigCache(maxSigCacheEntries), Events: NewEventBus()}
 }
 
-func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-	lockPath := filepath.Join(dir, "LOCK")
-	if err := os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
-	}
-	retryOpts := originalOpts
-	retryOpts.Truncate = true
-	db, err := badger.Open(retryOpts)
-	return db, err
+// Returns the hash of the tip of the chain
+func (chain *Blockchain) LastHash() []byte {
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
+	return chain.lastHash
 }
 
-func openDB(dir string, opts badger.Options) (*badger.DB, error) {
-	if db, err := badger.Open(opts); err != nil {
-		if strings.Contains(err.Error(), "LOCK") {
-			if db, err := retry(dir, opts); err == nil {
-				log.Println("database unlocked, value log truncated")
-				return db, nil
-			}
-			log.Println("could not unlock database:", err)
-		}
+func DbExists(path string) bool {
+	return storage.BadgerExists(path)
+}
+
+// Opens the database of a new chain, the directories of the node are created if needed
+func createDb(nodeId string) (*storage.BadgerStore, error) {
+	if err := datadir.Create(nodeId); err != nil {
 		return nil, err
-	} else {
-		return db, nil
 	}
+
+	return storage.OpenBadger(datadir.BlocksDir(nodeId))
 }
 
-func ContinueBlockchain(nodeId string) *Blockchain {
-	path := fmt.Sprintf(dbPath, nodeId)
+func ContinueBlockchain(nodeId string) (*Blockchain, error) {
+	path := datadir.BlocksDir(nodeId)
 
 	if DbExists(path) == false {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
+		return nil, ErrNoChain
 	}
 
-	var lastHash []byte
+	db, err := storage.OpenBadger(path)
+	if err != nil {
+		return nil, err
+	}
 
-	opts := badger.DefaultOptions
-	opts.Dir = path
-	opts.ValueDir = path
+	chain, err := NewBlockchain(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	db, err := openDB(path, opts)
+	return chain, nil
+}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		lastHash, err = item.Value()
-		return err
-	})
+// Opens a chain that was already created in the store
+func NewBlockchain(db storage.Store) (*Blockchain, error) {
+	lastHash, err := db.Get(lastHashKey)
+	if err == storage.ErrNotFound {
+		return nil, ErrNoChain
+	} else if err != nil {
+		return nil, err
+	}
 
-	HandleError(err)
+	return newChain(lastHash, db), nil
+}
 
-	return &Blockchain{lastHash, db}
+func InitBlockchain(address, nodeId string) (*Blockchain, error) {
+	if ChainExists(nodeId) {
+		return nil, ErrChainExists
+	}
 
+	db, err := createDb(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := InitBlockchainInStore(address, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return chain, nil
 }
 
-func InitBlockchain(address, nodeId string) *Blockchain {
-	path := fmt.Sprintf(dbPath, nodeId)
+// Creates a new chain in the store, the genesis block pays its reward to address
+func InitBlockchainInStore(address string, db storage.Store) (*Blockchain, error) {
+	if _, err := db.Get(lastHashKey); err == nil {
+		return nil, ErrChainExists
+	}
 
-	if DbExists(path) {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+	cbtx, err := CoinbaseTx(address, genesisData)
+	if err != nil {
+		return nil, err
 	}
+	genesis := Genesis(cbtx)
+	fmt.Println("Genesis created")
 
-	var lastHash []byte
+	if err := writeGenesis(db, genesis); err != nil {
+		return nil, err
+	}
+
+	return newChain(genesis.Hash, db), nil
+}
 
-	opts := badger.DefaultOptions
-	opts.Dir = path
-	opts.ValueDir = path
+// Creates the regtest chain in the store, a memory store gives a chain that is gone once it is closed
+func InitRegtestInStore(db storage.Store) (*Blockchain, error) {
+	if _, err := db.Get(lastHashKey); err == nil {
+		return nil, ErrChainExists
+	}
 
-	db, err := openDB(path, opts)
+	genesis, err := RegtestGenesis()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeGenesis(db, genesis); err != nil {
+		return nil, err
+	}
 
-	// Update lets make Read and Write transactions into the database
-	// We are sending an enclosure which takes in a pointer to a badger transaction
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis created")
-		err := txn.Set(genesis.Hash, genesis.Serialize())
-		HandleError(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
+	return newChain(genesis.Hash, db), nil
+}
 
-		lastHash = genesis.Hash
-		return err
+// The genesis block, its outputs and the tip are written together like any other block
+func writeGenesis(db storage.Store, genesis *Block) error {
+	return db.Update(func(batch storage.Batch) error {
+		if err := batch.Put(genesis.Hash, genesis.Serialize()); err != nil {
+			return err
+		}
+		if err := updateUTXO(batch, genesis); err != nil {
+			return err
+		}
+		return batch.Put(lastHashKey, genesis.Hash)
+	})
+}
 
+/*
+	Writes the block, its changes to the UTXO set and the new tip in a single transaction, so a
+	crash can't leave one without the others. The caller must hold the write lock
+*/
+func (chain *Blockchain) connectBlock(block *Block, tree *utxoNode) error {
+	err := chain.Database.Update(func(batch storage.Batch) error {
+		if err := batch.Put(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		if err := updateUTXO(batch, block); err != nil {
+			return err
+		}
+		return batch.Put(lastHashKey, block.Hash)
 	})
+	if err != nil {
+		return err
+	}
 
-	HandleError(err)
+	chain.lastHash = block.Hash
+	chain.cacheTree(block.Hash, tree)
+	chain.Events.Publish(Event{Type: BlockConnected, Block: block})
 
-	return &Blockchain{lastHash, db}
+	return nil
 }
 
-func (chain *Blockchain) AddBlock(block *Block) {
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(block.Hash); err == nil {
-			return nil
-		}
+/*
+	Validates and connects a block that must extend the tip. The validation runs under the write
+	lock, so the tip and the UTXO set it was checked against can't move before the block is written
+*/
+func (chain *Blockchain) connectTip(block *Block) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
 
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		HandleError(err)
+	if !bytes.Equal(block.PrevHash, chain.lastHash) {
+		return ErrStaleTip
+	}
+	tree, err := chain.checkTip(block)
+	if err != nil {
+		return err
+	}
 
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		lastHash, _ := item.Value()
+	return chain.connectBlock(block, tree)
+}
 
-		item, err = txn.Get(lastHash)
-		HandleError(err)
-		lastBlockData, _ := item.Value()
+/*
+	Adds a block received from another node, it is validated under the write lock before anything is
+	written. A block on top of the tip is connected to it. Any other block must link to a known block
+	and is stored, and if it is higher than the tip its whole branch is validated and the chain
+	switches to it. A pruned chain can only switch to a branch forking above its pruned blocks, for
+	a deeper one nothing is stored and the error wraps ErrBlockPruned. Invalid blocks fail with an
+	error wrapping ErrInvalidBlock
+*/
+func (chain *Blockchain) AddBlock(block *Block) error {
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
 
-		lastBlock := Deserialize(lastBlockData)
+	if _, err := chain.Database.Get(block.Hash); err == nil {
+		return nil
+	}
 
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			HandleError(err)
-			chain.LastHash = block.Hash
+	if bytes.Equal(block.PrevHash, chain.lastHash) {
+		tree, err := chain.checkTip(block)
+		if err != nil {
+			return err
 		}
+		return chain.connectBlock(block, tree)
+	}
 
-		return nil
+	if reason := checkBlockData(block); reason != "" {
+		return fmt.Errorf("%w %x: %s", ErrInvalidBlock, block.Hash, reason)
+	}
+	if _, err := chain.GetBlock(block.PrevHash); err != nil && err != ErrBlockPruned {
+		return err
+	}
+
+	tip, err := chain.lastBlock()
+	if err != nil {
+		return err
+	}
+	if block.Height > tip.Height {
+		branch, tree, err := chain.checkBranch(block)
+		if err != nil {
+			return err
+		}
+		return chain.switchBranch(branch, tree)
+	}
+
+	return chain.Database.Update(func(batch storage.Batch) error {
+		return batch.Put(block.Hash, block.Serialize())
 	})
-	HandleError(err)
 }
 
+/*
+	Moves the tip to the last block of a validated branch. The blocks of the old branch are reverted
+	with their undo data from the tip down to the fork and the ones of the new branch are connected
+	from the fork up, writing their own undo data, all in a single transaction with the blocks and
+	the new tip. Readers never see the UTXO set half way and a crash leaves the old tip untouched.
+	The disconnected blocks are published from the tip down, then the connected ones from the fork
+	up. The caller must hold the write lock
+*/
+func (chain *Blockchain) switchBranch(branch []*Block, tree *utxoNode) error {
+	var disconnected []*Block
+	for hash := chain.lastHash; !bytes.Equal(hash, branch[0].PrevHash); {
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		disconnected = append(disconnected, &block)
+		hash = block.PrevHash
+	}
+
+	tip := branch[len(branch)-1].Hash
+	err := chain.Database.Update(func(batch storage.Batch) error {
+		for _, block := range disconnected {
+			if err := undoUTXO(batch, block); err != nil {
+				return err
+			}
+		}
+		for _, block := range branch {
+			if err := batch.Put(block.Hash, block.Serialize()); err != nil {
+				return err
+			}
+			if err := updateUTXO(batch, block); err != nil {
+				return err
+			}
+		}
+		return batch.Put(lastHashKey, tip)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.lastHash = tip
+	chain.cacheTree(tip, tree)
+	for _, block := range disconnected {
+		chain.Events.Publish(Event{Type: BlockDisconnected, Block: block})
+	}
+	for _, block := range branch {
+		chain.Events.Publish(Event{Type: BlockConnected, Block: block})
+	}
+
+	return nil
+}
+
+// The header of a pruned block is returned together with ErrBlockPruned
 func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
-			return errors.New("Block is not found")
-		} else {
-			blockData, _ := item.Value()
+	blockData, err := chain.Database.Get(blockHash)
+	if err == storage.ErrNotFound {
+		return block, fmt.Errorf("Block %x: %w", blockHash, ErrNotFound)
+	} else if err != nil {
+		return block, err
+	}
 
-			block = *Deserialize(blockData)
-		}
-		return nil
-	})
+	decoded, err := Deserialize(blockData)
 	if err != nil {
 		return block, err
 	}
+	block = *decoded
+
+	if block.IsPruned() {
+		return block, ErrBlockPruned
+	}
 
 	return block, nil
 }
 
-func (chain *Blockchain) GetBlockHashes() [][]byte {
+func (chain *Blockchain) GetBlockHashes() ([][]byte, error) {
 	var blockHashes [][]byte
 
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		blockHashes = append(blockHashes, block.Hash)
 
@@ -189,72 +344,95 @@ func (chain *Blockchain) GetBlockHashes() [][]byte {
 		}
 	}
 
-	return blockHashes
+	return blockHashes, nil
 }
 
-func (chain *Blockchain) GetBestHeight() int {
-	var lastBlock Block
-
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		lastHash, _ := item.Value()
+func (chain *Blockchain) lastBlock() (*Block, error) {
+	lastHash, err := chain.Database.Get(lastHashKey)
+	if err != nil {
+		return nil, err
+	}
 
-		item, err = txn.Get(lastHash)
-		HandleError(err)
-		lastBlockData, _ := item.Value()
+	lastBlockData, err := chain.Database.Get(lastHash)
+	if err != nil {
+		return nil, err
+	}
 
-		lastBlock = *Deserialize(lastBlockData)
+	return Deserialize(lastBlockData)
+}
 
-		return nil
-	})
-	HandleError(err)
+func (chain *Blockchain) GetBestHeight() (int, error) {
+	lastBlock, err := chain.lastBlock()
+	if err != nil {
+		return 0, err
+	}
 
-	return lastBlock.Height
+	return lastBlock.Height, nil
 }
 
-func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var lastHeight int
-
-	for _, tx := range transactions {
-		if !chain.VerifyTransaction(tx) {
-			log.Panic("Invalid Transaction")
-		}
+/*
+	Mines a block with the transactions on top of the tip. No lock is held during the proof of work,
+	so if another block was connected in the meantime the mined block is dropped with ErrStaleTip
+*/
+func (chain *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
+	block, err := chain.PrepareBlock(transactions)
+	if err != nil {
+		return nil, err
 	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		HandleError(err)
-		lastHash, err = item.Value()
+	pow := NewProof(block)
+	block.Nonce, block.Hash = pow.Run()
 
-		item, err = txn.Get(lastHash)
-		HandleError(err)
-		lastBlockData, _ := item.Value()
+	if err := chain.connectTip(block); err != nil {
+		return nil, err
+	}
 
-		lastBlock := Deserialize(lastBlockData)
+	return block, nil
+}
 
-		lastHeight = lastBlock.Height
+/*
+	Builds the block on top of the tip with the transactions, without its proof of work, so it can
+	be mined outside the node and connected later with SubmitBlock
+*/
+func (chain *Blockchain) PrepareBlock(transactions []*Transaction) (*Block, error) {
+	if !chain.VerifyBlockTransactions(transactions) {
+		return nil, ErrInvalidTransaction
+	}
 
-		return err
-	})
-	HandleError(err)
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
 
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	lastBlock, err := chain.lastBlock()
+	if err != nil {
+		return nil, err
+	}
+	utxoRoot, err := UTXOSet{chain}.NextCommitment(transactions)
+	if err != nil {
+		return nil, err
+	}
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err = txn.Set(newBlock.Hash, newBlock.Serialize())
-		HandleError(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+	return newBlock(transactions, lastBlock.Hash, lastBlock.Height+1, utxoRoot), nil
+}
 
-		chain.LastHash = newBlock.Hash
+/*
+	Connects a block built by PrepareBlock with the nonce found for it. The block is not changed when
+	the nonce is wrong, and it fails with ErrStaleTip when the chain moved since it was prepared
+*/
+func (chain *Blockchain) SubmitBlock(prepared *Block, nonce int) (*Block, error) {
+	block := *prepared
+	block.Nonce = nonce
 
-		return err
-	})
+	pow := NewProof(&block)
+	if !pow.Validate() {
+		return nil, ErrInvalidProof
+	}
+	block.Hash = pow.Hash()
 
-	HandleError(err)
+	if err := chain.connectTip(&block); err != nil {
+		return nil, err
+	}
 
-	return newBlock
+	return &block, nil
 }
 
 /*
@@ -264,20 +442,32 @@ func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	still exits for a certain user so by counting all the used transaction that are
 	assigned to a certain user we can find how many tokens are assigned to that user.const
 */
-func (chain *Blockchain) FindUnspentTxO() map[string]TxOutputs {
+func (chain *Blockchain) FindUnspentTxO() (map[string]TxOutputs, error) {
+	return chain.findUnspentTxO(chain.LastHash())
+}
+
+func (chain *Blockchain) findUnspentTxO(tip []byte) (map[string]TxOutputs, error) {
 	UTXO := make(map[string]TxOutputs)
 	spentTXOs := make(map[string][]int)
 
-	iter := chain.Iterator()
+	iter := &BlockchainIterator{tip, chain.Database}
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
-		for _, tx := range block.Transactions {
+		// Backwards too, so the outputs spent later in the same block are already known as spent
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
 			for outIdx, out := range tx.Outputs {
+				if out.IsDataCarrier() {
+					continue
+				}
 				if spentTXOs[txID] != nil {
 					for _, spentOut := range spentTXOs[txID] {
 						if spentOut == outIdx {
@@ -287,6 +477,7 @@ func (chain *Blockchain) FindUnspentTxO() map[string]TxOutputs {
 				}
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
 				UTXO[txID] = outs
 			}
 			if tx.IsCoinbase() == false {
@@ -301,18 +492,37 @@ func (chain *Blockchain) FindUnspentTxO() map[string]TxOutputs {
 			break
 		}
 	}
-	return UTXO
+	return UTXO, nil
 }
 
 func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	block, err := chain.FindTransactionBlock(ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	for _, tx := range block.Transactions {
+		if bytes.Equal(tx.ID, ID) {
+			return *tx, nil
+		}
+	}
+
+	return Transaction{}, fmt.Errorf("Transaction %x: %w", ID, ErrNotFound)
+}
+
+// Returns the block where the transaction was included
+func (chain *Blockchain) FindTransactionBlock(ID []byte) (*Block, error) {
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Equal(tx.ID, ID) {
-				return *tx, nil
+				return block, nil
 			}
 		}
 
@@ -321,44 +531,85 @@ func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction does not exit")
+	return nil, fmt.Errorf("Transaction %x: %w", ID, ErrNotFound)
 }
 
-func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTxs := make(map[string]Transaction)
+func (chain *Blockchain) SignTransaction(tx *Transaction, w *wallet.Wallet) error {
+	return chain.SignTransactionWithHashType(tx, w, SigHashAll)
+}
 
-	for _, in := range tx.Inputs {
-		prevTX, err := chain.FindTransaction(in.ID)
-		HandleError(err)
-		prevTxs[hex.EncodeToString(prevTX.ID)] = prevTX
+/*
+	Finds the transaction with the outputs spent by an input. If its block was pruned we can still
+	rebuild its unspent outputs from the UTXO set, which is all we need to sign and verify the input
+*/
+func (chain *Blockchain) FindPreviousTransaction(ID []byte) (Transaction, error) {
+	tx, err := chain.FindTransaction(ID)
+	if err == nil {
+		return tx, nil
+	}
+
+	return UTXOSet{chain}.FindTransaction(ID)
+}
+
+func (chain *Blockchain) SignTransactionWithHashType(tx *Transaction, w *wallet.Wallet, hashType SigHashType) error {
+	prevTxs, err := chain.GetPreviousTransactions(tx)
+	if err != nil {
+		return err
 	}
-	tx.Sign(privKey, prevTxs)
+
+	return tx.SignWithHashType(w, prevTxs, hashType)
 }
 
+/*
+	Verifies a transaction before it is accepted, the valid signatures are stored in the signature
+	cache so they are not verified again when the transaction is mined or arrives inside of a block
+*/
 func (chain *Blockchain) VerifyTransaction(tx *Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
 
-	prevTxs := make(map[string]Transaction)
+	prevTxs, err := chain.GetPreviousTransactions(tx)
+	if err != nil {
+		return false
+	}
 
-	for _, in := range tx.Inputs {
-		prevTX, err := chain.FindTransaction(in.ID)
-		HandleError(err)
-		prevTxs[hex.EncodeToString(prevTX.ID)] = prevTX
+	return chain.VerifyTransactionWith(tx, prevTxs)
+}
+
+// Same as VerifyTransaction with the previous transactions given, some of them can still be unconfirmed
+func (chain *Blockchain) VerifyTransactionWith(tx *Transaction, prevTxs map[string]Transaction) bool {
+	if tx.IsCoinbase() {
+		return true
+	}
+
+	if !checkDataCarriers(tx) || !tx.checkIfInputsExists(prevTxs) {
+		return false
 	}
 
-	return tx.Verify(prevTxs)
+	return verifyInputs(inputChecks(tx, prevTxs), chain.SigCache, true)
+}
+
+func (chain *Blockchain) GetPreviousTransactions(tx *Transaction) (map[string]Transaction, error) {
+	return chain.previousTransactions(tx, nil)
 }
 
-func (chain *Blockchain) GetPreviousTransactions(tx *Transaction) map[string]Transaction {
+// Transactions in pending are used before the ones of the chain, like the earlier ones of a new block
+func (chain *Blockchain) previousTransactions(tx *Transaction, pending map[string]*Transaction) (map[string]Transaction, error) {
 	prevTxs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
-		prevTx, err := chain.FindTransaction(in.ID)
-		HandleError(err)
+		if prevTx, ok := pending[hex.EncodeToString(in.ID)]; ok {
+			prevTxs[hex.EncodeToString(prevTx.ID)] = *prevTx
+			continue
+		}
+
+		prevTx, err := chain.FindPreviousTransaction(in.ID)
+		if err != nil {
+			return nil, err
+		}
 		prevTxs[hex.EncodeToString(prevTx.ID)] = prevTx
 	}
 
-	return prevTxs
+	return prevTxs, nil
 }
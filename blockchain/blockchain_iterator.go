@@ -1,32 +1,29 @@
 package blockchain
 
-import "github.com/dgraph-io/badger"
+import "github.com/blockchain-app-go/storage"
 
 type BlockchainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Database    storage.Store
 }
 
 func (chain *Blockchain) Iterator() *BlockchainIterator {
-	iter := &BlockchainIterator{chain.LastHash, chain.Database}
+	iter := &BlockchainIterator{chain.LastHash(), chain.Database}
 
 	return iter
 }
 
-func (iter *BlockchainIterator) Next() *Block {
-	var block *Block
-
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		HandleError(err)
-		encodedBlock, err := item.Value()
-		block = Deserialize(encodedBlock)
-
-		return err
-	})
-	HandleError(err)
+func (iter *BlockchainIterator) Next() (*Block, error) {
+	encodedBlock, err := iter.Database.Get(iter.CurrentHash)
+	if err != nil {
+		return nil, err
+	}
 
+	block, err := Deserialize(encodedBlock)
+	if err != nil {
+		return nil, err
+	}
 	iter.CurrentHash = block.PrevHash
 
-	return block
+	return block, nil
 }
@@ -0,0 +1,228 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+)
+
+/*
+	Blocks of a longer chain arrive from several peers at once, in any order and more than once,
+	while the node mines its own blocks and other goroutines read the chain. Run with -race
+*/
+func TestConcurrentAddBlock(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	genesis := newTestGenesis(t, string(alice.Address()))
+	source := newTestChainFrom(t, genesis)
+	chain := newTestChainFrom(t, genesis)
+
+	var blocks []*Block
+	for i := 0; i < 5; i++ {
+		txs := []*Transaction{newCoinbase(t, string(alice.Address()), 1)}
+		tx, err := NewTransaction(alice, string(bob.Address()), 1, 1, UTXOSet{source})
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, mineTestBlock(t, source, append(txs, tx)...))
+	}
+
+	// The blocks of the node are prepared on the genesis, so the longer chain must win over them
+	var mined []*Block
+	for miner := 0; miner < 2; miner++ {
+		mined = append(mined, prepareTestBlock(t, chain, newCoinbase(t, string(bob.Address()), 0)))
+	}
+
+	var wg sync.WaitGroup
+	for peer := 0; peer < 3; peer++ {
+		for _, block := range blocks {
+			wg.Add(1)
+			go func(block *Block) {
+				defer wg.Done()
+				// A block whose parent didn't arrive yet is refused, the peer sends it again
+				for {
+					err := chain.AddBlock(block)
+					if err == nil {
+						return
+					}
+					if !errors.Is(err, ErrNotFound) {
+						t.Errorf("Block %d: %s", block.Height, err)
+						return
+					}
+				}
+			}(block)
+		}
+	}
+
+	for _, block := range mined {
+		wg.Add(1)
+		go func(block *Block) {
+			defer wg.Done()
+			if _, err := chain.SubmitBlock(block, block.Nonce); err != nil && err != ErrStaleTip {
+				t.Error(err)
+			}
+		}(block)
+	}
+
+	for reader := 0; reader < 2; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if _, err := chain.VerifyChain(0); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if t.Failed() {
+		return
+	}
+	if !bytes.Equal(chain.LastHash(), source.LastHash()) {
+		t.Fatalf("The tip is %x, expected the longer chain %x", chain.LastHash(), source.LastHash())
+	}
+	if _, err := chain.VerifyChain(0); err != nil {
+		t.Fatal(err)
+	}
+	got, err := UTXOSet{chain}.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := UTXOSet{source}.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("The UTXO set differs from the one of the longer chain")
+	}
+}
+
+func TestAddBlockRejectsInvalidBlocks(t *testing.T) {
+	alice := newTestWallet(t)
+	genesis := newTestGenesis(t, string(alice.Address()))
+	source := newTestChainFrom(t, genesis)
+	chain := newTestChainFrom(t, genesis)
+
+	// The coinbase takes twice the subsidy
+	inflated := forgeTestBlock(t, source, newCoinbase(t, string(alice.Address()), Subsidy))
+	if err := chain.AddBlock(inflated); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("Block extending the tip with an inflated coinbase returned %v", err)
+	}
+
+	tampered := *mineTestBlock(t, source, newCoinbase(t, string(alice.Address()), 0))
+	tampered.Nonce++
+	if err := chain.AddBlock(&tampered); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("Block with a wrong nonce returned %v", err)
+	}
+
+	// A branch higher than the tip is replayed from the fork, the invalid block is found before the switch
+	mineTestBlock(t, chain, newCoinbase(t, string(alice.Address()), 0))
+	tip := chain.LastHash()
+	valid, err := source.GetBlock(source.LastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AddBlock(&valid); err != nil {
+		t.Fatal(err)
+	}
+	invalid := forgeTestBlock(t, source, newCoinbase(t, string(alice.Address()), Subsidy))
+	if err := chain.AddBlock(invalid); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("Longer branch with an invalid block returned %v", err)
+	}
+	if !bytes.Equal(chain.LastHash(), tip) {
+		t.Fatal("The chain switched to the invalid branch")
+	}
+	if _, err := chain.GetBlock(invalid.Hash); !errors.Is(err, ErrNotFound) {
+		t.Fatal("The invalid block was stored")
+	}
+	if _, err := chain.VerifyChain(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The negative output cancels the extra coins in the total, so only a check of every output finds it
+func TestAddBlockRejectsNegativeOutputs(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	genesis := newTestGenesis(t, string(alice.Address()))
+	source := newTestChainFrom(t, genesis)
+	chain := newTestChainFrom(t, genesis)
+
+	coinbase := newCoinbase(t, string(alice.Address()), 0)
+	for _, value := range []int{1000, -1000} {
+		to := alice
+		if value < 0 {
+			to = bob
+		}
+		out, err := NewTxOutput(value, string(to.Address()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		coinbase.Outputs = append(coinbase.Outputs, *out)
+	}
+	coinbase.ID = coinbase.Hash()
+
+	block := forgeTestBlock(t, source, coinbase)
+	if err := chain.AddBlock(block); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("Block whose coinbase pays +20, +1000 and -1000 returned %v", err)
+	}
+	if !bytes.Equal(chain.LastHash(), genesis.Hash) {
+		t.Fatal("The block was connected")
+	}
+
+	// A chain that took the block anyway is found inconsistent, its tree is not used again
+	if err := source.connectBlock(block, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.VerifyChain(0); err == nil {
+		t.Fatal("VerifyChain accepted the block")
+	}
+}
+
+// The blocks of the new branch are connected one by one, so each of them can be reverted again
+func TestReorgWritesUndoData(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	genesis := newTestGenesis(t, string(alice.Address()))
+	source := newTestChainFrom(t, genesis)
+	chain := newTestChainFrom(t, genesis)
+
+	mineTestBlock(t, chain, newCoinbase(t, string(bob.Address()), 0))
+	var branch []*Block
+	for i := 0; i < 3; i++ {
+		tx, err := NewTransaction(alice, string(bob.Address()), 1, 1, UTXOSet{source})
+		if err != nil {
+			t.Fatal(err)
+		}
+		branch = append(branch, mineTestBlock(t, source, newCoinbase(t, string(alice.Address()), 1), tx))
+	}
+	for _, block := range branch {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(chain.LastHash(), source.LastHash()) {
+		t.Fatal("The chain didn't switch to the longer branch")
+	}
+
+	for _, block := range branch {
+		got, err := UTXOSet{chain}.Snapshot(block.Height - 1)
+		if err != nil {
+			t.Fatalf("Snapshot below block %d: %s", block.Height, err)
+		}
+		expected, err := UTXOSet{source}.Snapshot(block.Height - 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Hash, expected.Hash) {
+			t.Fatalf("The UTXO set below block %d differs from the one of the branch", block.Height)
+		}
+	}
+	if _, err := chain.VerifyChain(0); err != nil {
+		t.Fatal(err)
+	}
+}
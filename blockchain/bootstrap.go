@@ -0,0 +1,157 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/blockchain-app-go/datadir"
+)
+
+// Bigger records in a bootstrap file are taken as corruption instead of being read into memory
+const maxBootstrapBlockSize = 32 << 20
+
+/*
+	A bootstrap file is a stream of serialized blocks from the oldest to the newest, each one
+	prefixed with its length as a big endian uint32
+*/
+func WriteBlock(w io.Writer, block *Block) error {
+	data := block.Serialize()
+
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+
+	return err
+}
+
+// Returns io.EOF once the stream ends after a complete block
+func ReadBlock(r io.Reader) (*Block, error) {
+	var length uint32
+
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("Bootstrap file ends in the middle of a block")
+		}
+		return nil, err
+	}
+	if length > maxBootstrapBlockSize {
+		return nil, fmt.Errorf("Block of %d bytes is too big", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.New("Bootstrap file ends in the middle of a block")
+	}
+
+	var block Block
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block); err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+// Writes the blocks with heights between from and to, a negative to means up to the tip
+func (chain *Blockchain) ExportBlocks(w io.Writer, from, to int) (int, error) {
+	var hashes [][]byte
+
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		if block.Height < from {
+			break
+		}
+		if to < 0 || block.Height <= to {
+			hashes = append(hashes, block.Hash)
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := chain.GetBlock(hashes[i])
+		if err == ErrBlockPruned {
+			return 0, fmt.Errorf("Block %d is pruned and cannot be exported", block.Height)
+		} else if err != nil {
+			return 0, err
+		}
+
+		if err := WriteBlock(w, &block); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(hashes), nil
+}
+
+// The proof of work must be valid and the hash of the block must be the one it proves
+func checkProofOfWork(block *Block) error {
+	pow := NewProof(block)
+	hash := sha256.Sum256(pow.InitData(block.Nonce))
+
+	if !pow.Validate() || !bytes.Equal(hash[:], block.Hash) {
+		return fmt.Errorf("Block %x has an invalid proof of work", block.Hash)
+	}
+
+	return nil
+}
+
+/*
+	Validates a block from a bootstrap file and connects it to the tip. Known blocks are skipped so
+	an interrupted import can be resumed with the same file. The block, the UTXO set and the tip are
+	written together, so an interruption never leaves a block half imported
+*/
+func (chain *Blockchain) ImportBlock(block *Block) (bool, error) {
+	if _, err := chain.GetBlock(block.Hash); err == nil || err == ErrBlockPruned {
+		return false, nil
+	}
+
+	if err := chain.connectTip(block); err == ErrStaleTip {
+		return false, fmt.Errorf("Block %x does not extend the tip of the chain", block.Hash)
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Creates the database of a new node from the genesis block of a bootstrap file
+func InitBlockchainFromGenesis(genesis *Block, nodeId string) (*Blockchain, error) {
+	if ChainExists(nodeId) {
+		return nil, ErrChainExists
+	}
+	if genesis.Height != 0 || len(genesis.PrevHash) != 0 || genesis.IsPruned() {
+		return nil, errors.New("The first block is not a genesis block")
+	}
+	if err := checkProofOfWork(genesis); err != nil {
+		return nil, err
+	}
+
+	db, err := createDb(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeGenesis(db, genesis); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newChain(genesis.Hash, db), nil
+}
+
+func ChainExists(nodeId string) bool {
+	return DbExists(datadir.BlocksDir(nodeId))
+}
@@ -0,0 +1,318 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/blockchain-app-go/storage"
+)
+
+/*
+	Every block commits to the UTXO set left after it with the root of the tree of its unspent
+	outputs. Light clients can then check that an output is unspent with the path of its leaf to
+	the root of a header instead of trusting a full node
+*/
+func UTXOCommitment(entries []UTXOEntry) []byte {
+	return buildUTXOTree(entries).root()
+}
+
+// Removes the output spent by the input from an in-memory UTXO set
+func spendOutput(set map[string]TxOutputs, in TxInput) error {
+	inID := hex.EncodeToString(in.ID)
+	outs := set[inID]
+	updatedOuts := TxOutputs{}
+	spent := false
+
+	for i, out := range outs.Outputs {
+		if outs.Index(i) == in.Out && !spent {
+			spent = true
+			continue
+		}
+		updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+		updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(i))
+	}
+
+	if !spent {
+		return fmt.Errorf("Output %x:%d is not in the UTXO set", in.ID, in.Out)
+	}
+	if len(updatedOuts.Outputs) == 0 {
+		delete(set, inID)
+	} else {
+		set[inID] = updatedOuts
+	}
+
+	return nil
+}
+
+// Adds the spendable outputs of the transaction to an in-memory UTXO set
+func addOutputs(set map[string]TxOutputs, tx *Transaction) {
+	newOutputs := TxOutputs{}
+	for outIdx, out := range tx.Outputs {
+		if out.IsDataCarrier() {
+			continue
+		}
+		newOutputs.Outputs = append(newOutputs.Outputs, out)
+		newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+	}
+	if len(newOutputs.Outputs) > 0 {
+		set[hex.EncodeToString(tx.ID)] = newOutputs
+	}
+}
+
+// The hex of IDs with the same length sorts like the IDs, which is the order of the database
+func sortedEntries(set map[string]TxOutputs) ([]UTXOEntry, error) {
+	var txIDs []string
+	for txID := range set {
+		txIDs = append(txIDs, txID)
+	}
+	sort.Strings(txIDs)
+
+	var result []UTXOEntry
+	for _, txID := range txIDs {
+		ID, err := hex.DecodeString(txID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, UTXOEntry{ID, set[txID]})
+	}
+
+	return result, nil
+}
+
+/*
+	The entries of the UTXO set changed by the blocks being validated, together with the tree of the
+	whole set after them. An entry is read from the database the first time it is touched and only
+	changed in memory, so nothing is written until the blocks are known to be valid, and the tree is
+	updated with the outputs each change removed and added. A state without a database starts from
+	an empty set and has all its entries in memory
+*/
+type utxoState struct {
+	db     storage.Store
+	set    map[string]TxOutputs // By the hex of the transaction IDs
+	loaded map[string]bool
+	tree   *utxoNode
+}
+
+func newUTXOState(db storage.Store, tree *utxoNode) *utxoState {
+	return &utxoState{db: db, set: make(map[string]TxOutputs), loaded: make(map[string]bool), tree: tree}
+}
+
+// Reads the entries of the transactions not touched yet, then returns them as they are before a change
+func (state *utxoState) track(txIDs [][]byte) (map[string]TxOutputs, error) {
+	before := make(map[string]TxOutputs)
+
+	for _, txID := range txIDs {
+		key := hex.EncodeToString(txID)
+		if state.db != nil && !state.loaded[key] {
+			v, err := state.db.Get(append(utxoPrefix, txID...))
+			if err == nil {
+				outs, err := DeserializeOutputs(v)
+				if err != nil {
+					return nil, err
+				}
+				state.set[key] = outs
+			} else if err != storage.ErrNotFound {
+				return nil, err
+			}
+			state.loaded[key] = true
+		}
+		before[key] = state.set[key]
+	}
+
+	return before, nil
+}
+
+// Updates the tree with the changes made to the tracked entries since track returned them
+func (state *utxoState) commit(before map[string]TxOutputs) error {
+	for key, outs := range before {
+		txID, err := hex.DecodeString(key)
+		if err != nil {
+			return err
+		}
+		for i := range outs.Outputs {
+			state.tree = state.tree.remove(outpointKey(txID, outs.Index(i)), 0)
+		}
+		after := state.set[key]
+		for i, out := range after.Outputs {
+			state.tree = state.tree.insert(newUTXOLeaf(txID, after.Index(i), out), 0)
+		}
+	}
+
+	return nil
+}
+
+// The entries a block changes, the ones of its transactions and the ones they spend from
+func touchedEntries(txs []*Transaction) [][]byte {
+	var txIDs [][]byte
+	for _, tx := range txs {
+		txIDs = append(txIDs, tx.ID)
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				txIDs = append(txIDs, in.ID)
+			}
+		}
+	}
+
+	return txIDs
+}
+
+// Applies the transactions to the state, the same way updateUTXO does on the database
+func (state *utxoState) applyTransactions(txs []*Transaction) error {
+	before, err := state.track(touchedEntries(txs))
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				if err := spendOutput(state.set, in); err != nil {
+					return err
+				}
+			}
+		}
+
+		addOutputs(state.set, tx)
+	}
+
+	return state.commit(before)
+}
+
+// Reverts the block on the state with its undo data, the same way undoUTXO does on the database
+func (state *utxoState) disconnect(block *Block, undo BlockUndo) error {
+	txIDs := touchedEntries(block.Transactions)
+	for _, spent := range undo.Spent {
+		txIDs = append(txIDs, spent.TxID)
+	}
+	before, err := state.track(txIDs)
+	if err != nil {
+		return err
+	}
+
+	undoTransactions(state.set, block, undo)
+
+	return state.commit(before)
+}
+
+/*
+	Returns the commitment to the UTXO set after a block with these transactions is added on top of
+	the tip. Only the entries they touch are read. The caller must hold the lock
+*/
+func (u UTXOSet) NextCommitment(txs []*Transaction) ([]byte, error) {
+	tree, err := u.Blockchain.tipTree()
+	if err != nil {
+		return nil, err
+	}
+
+	state := newUTXOState(u.Blockchain.Database, tree)
+	if err := state.applyTransactions(txs); err != nil {
+		return nil, err
+	}
+
+	return state.tree.root(), nil
+}
+
+// Proves that the unspent outputs of a transaction are in the UTXO set committed by a block header
+type UTXOProof struct {
+	TxID    []byte
+	Outputs TxOutputs
+	Header  []byte     // Serialized header of the block with the commitment
+	Proofs  [][][]byte // Hashes of the siblings on the path of each output, from the root down
+}
+
+func (proof UTXOProof) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(proof)
+	HandleError(err)
+	return buffer.Bytes()
+}
+
+func DeserializeUTXOProof(data []byte) (*UTXOProof, error) {
+	var proof UTXOProof
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&proof); err != nil {
+		return nil, err
+	}
+
+	return &proof, nil
+}
+
+// Builds the proof of the unspent outputs of a transaction against the commitment of the tip
+func (u UTXOSet) Proof(txID []byte) (*UTXOProof, error) {
+	chain := u.Blockchain
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
+	tip, err := chain.GetBlock(chain.lastHash)
+	if err != nil && err != ErrBlockPruned {
+		return nil, err
+	}
+	if len(tip.UTXORoot) == 0 {
+		return nil, errors.New("The tip of the chain does not commit to the UTXO set")
+	}
+
+	tree, err := chain.tipTree()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tree.root(), tip.UTXORoot) {
+		return nil, errors.New("The UTXO set does not match the commitment of the tip, reindex it")
+	}
+
+	proof := &UTXOProof{TxID: txID, Header: tip.Header().Serialize()}
+
+	v, err := chain.Database.Get(append(utxoPrefix, txID...))
+	if err == storage.ErrNotFound {
+		return nil, errors.New("Transaction has no unspent outputs")
+	} else if err != nil {
+		return nil, err
+	}
+	if proof.Outputs, err = DeserializeOutputs(v); err != nil {
+		return nil, err
+	}
+	for i := range proof.Outputs.Outputs {
+		siblings, ok := tree.path(outpointKey(txID, proof.Outputs.Index(i)))
+		if !ok {
+			return nil, fmt.Errorf("Output %d is not in the tree of the UTXO set", proof.Outputs.Index(i))
+		}
+		proof.Proofs = append(proof.Proofs, siblings)
+	}
+
+	if len(proof.Proofs) == 0 {
+		return nil, errors.New("Transaction has no unspent outputs")
+	}
+
+	return proof, nil
+}
+
+// Checks the proof of work of the header and the path of every output against its commitment
+func (proof *UTXOProof) Verify() error {
+	header, err := Deserialize(proof.Header)
+	if err != nil {
+		return err
+	}
+
+	if !NewProof(header).Validate() {
+		return errors.New("Invalid proof of work in the header")
+	}
+	if len(header.UTXORoot) == 0 {
+		return errors.New("The header does not commit to the UTXO set")
+	}
+	if len(proof.Proofs) != len(proof.Outputs.Outputs) {
+		return errors.New("There must be one path for each output")
+	}
+
+	for i, out := range proof.Outputs.Outputs {
+		if !verifyUTXOPath(proof.TxID, proof.Outputs.Index(i), out, proof.Proofs[i], header.UTXORoot) {
+			return fmt.Errorf("Invalid path for output %d", proof.Outputs.Index(i))
+		}
+	}
+
+	return nil
+}
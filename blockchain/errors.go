@@ -0,0 +1,25 @@
+package blockchain
+
+import (
+	"errors"
+
+	"github.com/blockchain-app-go/storage"
+)
+
+/*
+	Errors returned by the blockchain package. They can be wrapped with more details, so callers
+	must compare them with errors.Is
+*/
+var (
+	ErrNotFound           = storage.ErrNotFound // A block, transaction or record is not in the chain
+	ErrChainExists        = errors.New("Blockchain already exists")
+	ErrNoChain            = errors.New("No existing blockchain found, create one!")
+	ErrInsufficientFunds  = errors.New("Not enough funds")
+	ErrInvalidTransaction = errors.New("Invalid transaction")
+	ErrDataTooLarge       = errors.New("Data is bigger than the data carrier size")
+	ErrStaleTip           = errors.New("The tip of the chain changed before the block was connected")
+	ErrFeeTooLow          = errors.New("The new fee must be higher than the fee of the transaction")
+	ErrInvalidProof       = errors.New("The hash of the block doesn't meet the target")
+	ErrInvalidBlock       = errors.New("Invalid block")
+	ErrNoSingleOutput     = errors.New("SINGLE signature without an output for the input")
+)
@@ -0,0 +1,131 @@
+package blockchain
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Size of the channel of a subscription when the subscriber doesn't choose one
+const DefaultEventBuffer = 100
+
+type EventType int
+
+const (
+	BlockConnected       EventType = iota // The block was added on top of the tip and its transactions are in the UTXO set
+	BlockDisconnected                     // The changes of the block in the UTXO set were reverted, also when the chain switched branch
+	TxAcceptedToMempool                   // The transaction was verified and is waiting to be mined
+	TxRemovedFromMempool                  // The transaction was mined or dropped from the memory pool
+)
+
+func (eventType EventType) String() string {
+	switch eventType {
+	case BlockConnected:
+		return "BlockConnected"
+	case BlockDisconnected:
+		return "BlockDisconnected"
+	case TxAcceptedToMempool:
+		return "TxAcceptedToMempool"
+	case TxRemovedFromMempool:
+		return "TxRemovedFromMempool"
+	}
+
+	return "Unknown"
+}
+
+/*
+	Block is set on the block events and Tx on the memory pool ones. Every event published by the
+	bus gets the next sequence number, which orders the events seen by different subscriptions
+*/
+type Event struct {
+	Type   EventType
+	Seq    uint64
+	Block  *Block
+	Tx     *Transaction
+	Reason string // Why the transaction was removed from the memory pool
+}
+
+/*
+	The event bus delivers the events of the chain to its subscribers over buffered channels. A slow
+	subscriber never holds back the chain: when its buffer is full the event is dropped for it and
+	counted, so the subscriber knows it has to read the chain again to catch up
+*/
+type EventBus struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+	seq         uint64
+}
+
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	types   map[EventType]bool // Empty to receive every type
+	dropped uint64
+	bus     *EventBus
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribes to the given types of events, or to all of them when no type is given
+func (bus *EventBus) Subscribe(buffer int, types ...EventType) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+
+	ch := make(chan Event, buffer)
+	sub := &Subscription{C: ch, ch: ch, types: make(map[EventType]bool), bus: bus}
+	for _, eventType := range types {
+		sub.types[eventType] = true
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+// Sends the event to every subscriber interested in it without waiting for any of them
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+
+	// The lock is exclusive so every subscriber gets the events in the order of their sequence
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	bus.seq++
+	event.Seq = bus.seq
+
+	for sub := range bus.subscribers {
+		if len(sub.types) > 0 && !sub.types[event.Type] {
+			continue
+		}
+
+		select {
+		case sub.ch <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Number of events that were dropped because the channel of the subscription was full
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Stops the delivery of events and closes the channel, it can be called more than once
+func (sub *Subscription) Close() {
+	bus := sub.bus
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	if _, ok := bus.subscribers[sub]; ok {
+		delete(bus.subscribers, sub)
+		close(sub.ch)
+	}
+}
@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReorgPublishesDisconnectThenConnect(t *testing.T) {
+	alice := newTestWallet(t)
+	genesis := newTestGenesis(t, string(alice.Address()))
+	source := newTestChainFrom(t, genesis)
+	chain := newTestChainFrom(t, genesis)
+
+	old := mineTestBlock(t, chain, newCoinbase(t, string(alice.Address()), 0))
+	branch := []*Block{
+		mineTestBlock(t, source, newCoinbase(t, string(alice.Address()), 0)),
+		mineTestBlock(t, source, newCoinbase(t, string(alice.Address()), 0)),
+	}
+
+	sub := chain.Events.Subscribe(0, BlockConnected, BlockDisconnected)
+	defer sub.Close()
+	for _, block := range branch {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []struct {
+		eventType EventType
+		block     *Block
+	}{
+		{BlockDisconnected, old},
+		{BlockConnected, branch[0]},
+		{BlockConnected, branch[1]},
+	}
+	var seq uint64
+	for _, e := range expected {
+		var event Event
+		select {
+		case event = <-sub.C:
+		default:
+			t.Fatalf("Missing %s of block %d", e.eventType, e.block.Height)
+		}
+		if event.Type != e.eventType || !bytes.Equal(event.Block.Hash, e.block.Hash) {
+			t.Fatalf("Got %s of block %d, expected %s of block %d", event.Type, event.Block.Height, e.eventType, e.block.Height)
+		}
+		if event.Seq <= seq {
+			t.Fatalf("Event %d published after event %d", event.Seq, seq)
+		}
+		seq = event.Seq
+	}
+	select {
+	case event := <-sub.C:
+		t.Fatalf("Unexpected %s of block %d", event.Type, event.Block.Height)
+	default:
+	}
+}
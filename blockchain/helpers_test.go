@@ -0,0 +1,144 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-app-go/storage"
+	"github.com/blockchain-app-go/wallet"
+)
+
+// Finds the nonce of the block without printing every hash like Run does, so the tests stay fast
+func solve(block *Block) {
+	var intHash big.Int
+
+	pow := NewProof(block)
+	prefix := pow.HeaderPrefix()
+	for nonce := 0; ; nonce++ {
+		hash := sha256.Sum256(PowData(prefix, int64(nonce), Difficulty))
+		if intHash.SetBytes(hash[:]).Cmp(pow.Target) == -1 {
+			block.Nonce = nonce
+			block.Hash = hash[:]
+			return
+		}
+	}
+}
+
+func newTestWallet(t *testing.T) *wallet.Wallet {
+	t.Helper()
+
+	w, err := wallet.MakeWallet(wallet.P256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+// A genesis block paying its reward to address, so several chains can start from the same one
+func newTestGenesis(t *testing.T, address string) *Block {
+	t.Helper()
+
+	cbtx, err := CoinbaseTx(address, genesisData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := []*Transaction{cbtx}
+	state := newUTXOState(nil, nil)
+	if err := state.applyTransactions(txs); err != nil {
+		t.Fatal(err)
+	}
+	genesis := newBlock(txs, []byte{}, 0, state.tree.root())
+	solve(genesis)
+
+	return genesis
+}
+
+// A chain in a memory store starting with the genesis block
+func newTestChainFrom(t *testing.T, genesis *Block) *Blockchain {
+	t.Helper()
+
+	db := storage.NewMemoryStore()
+	if err := writeGenesis(db, genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	return newChain(genesis.Hash, db)
+}
+
+// A chain in a memory store whose genesis block pays its reward to address
+func newTestChain(t *testing.T, address string) *Blockchain {
+	t.Helper()
+
+	return newTestChainFrom(t, newTestGenesis(t, address))
+}
+
+func newCoinbase(t *testing.T, address string, fees int) *Transaction {
+	t.Helper()
+
+	cbtx, err := CoinbaseTxWithFees(address, "", fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cbtx
+}
+
+// Builds the next block of the chain with the transactions, which start with their coinbase
+func prepareTestBlock(t *testing.T, chain *Blockchain, txs ...*Transaction) *Block {
+	t.Helper()
+
+	block, err := chain.PrepareBlock(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solve(block)
+
+	return block
+}
+
+func mineTestBlock(t *testing.T, chain *Blockchain, txs ...*Transaction) *Block {
+	t.Helper()
+
+	prepared := prepareTestBlock(t, chain, txs...)
+	block, err := chain.SubmitBlock(prepared, prepared.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// Builds the next block of the chain without checking its transactions, like a dishonest miner would
+func forgeTestBlock(t *testing.T, chain *Blockchain, txs ...*Transaction) *Block {
+	t.Helper()
+
+	tip, err := chain.lastBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxoRoot, err := UTXOSet{chain}.NextCommitment(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := newBlock(txs, tip.Hash, tip.Height+1, utxoRoot)
+	solve(block)
+
+	return block
+}
+
+func balance(t *testing.T, chain *Blockchain, w *wallet.Wallet) int {
+	t.Helper()
+
+	outs, err := UTXOSet{chain}.FindUnspentTransactions(wallet.PublicKeyHash(w.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, out := range outs {
+		total += out.Value
+	}
+
+	return total
+}
@@ -0,0 +1,114 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/blockchain-app-go/storage"
+)
+
+func TestRegtestChainInMemory(t *testing.T) {
+	db := storage.NewMemoryStore()
+	chain, err := InitRegtestInStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, ok := findSnapshotParams(0)
+	if !ok {
+		t.Fatal("The regtest genesis is not pinned in AssumeUTXO")
+	}
+	if hex.EncodeToString(chain.LastHash()) != params.BlockHash {
+		t.Fatalf("Regtest genesis %x, pinned %s", chain.LastHash(), params.BlockHash)
+	}
+	hash, err := UTXOSet{chain}.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(hash) != params.UTXOHash {
+		t.Fatalf("Regtest UTXO set %x, pinned %s", hash, params.UTXOHash)
+	}
+
+	if _, err := InitRegtestInStore(db); !errors.Is(err, ErrChainExists) {
+		t.Fatalf("Creating the chain twice in the store returned %v", err)
+	}
+	reopened, err := NewBlockchain(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.LastHash(), chain.LastHash()) {
+		t.Fatal("The reopened chain has another tip")
+	}
+}
+
+func TestUTXOSetInMemory(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	chain := newTestChain(t, string(alice.Address()))
+	utxo := UTXOSet{chain}
+
+	mineTestBlock(t, chain, newCoinbase(t, string(alice.Address()), 0))
+	if got := balance(t, chain, alice); got != 2*Subsidy {
+		t.Fatalf("Alice has %d, expected %d", got, 2*Subsidy)
+	}
+	before, err := utxo.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := NewTransaction(alice, string(bob.Address()), 5, 1, utxo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := mineTestBlock(t, chain, newCoinbase(t, string(alice.Address()), 1), tx)
+	if got := balance(t, chain, bob); got != 5 {
+		t.Fatalf("Bob has %d, expected 5", got)
+	}
+	if got := balance(t, chain, alice); got != 3*Subsidy-5 {
+		t.Fatalf("Alice has %d, expected %d", got, 3*Subsidy-5)
+	}
+
+	report, err := chain.VerifyChain(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Height != 2 || !report.UTXOChecked {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	after, err := utxo.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utxo.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	reindexed, err := utxo.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(HashUTXOEntries(reindexed), HashUTXOEntries(after)) {
+		t.Fatal("Reindex changed the UTXO set")
+	}
+
+	snapshot, err := utxo.Snapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(snapshot.Hash, HashUTXOEntries(before)) {
+		t.Fatal("The snapshot at height 1 is not the UTXO set after block 1")
+	}
+
+	if err := utxo.Undo(block); err != nil {
+		t.Fatal(err)
+	}
+	undone, err := utxo.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(HashUTXOEntries(undone), HashUTXOEntries(before)) {
+		t.Fatal("Undo didn't restore the UTXO set before the block")
+	}
+}
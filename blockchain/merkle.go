@@ -1,6 +1,9 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
@@ -12,6 +15,12 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// One step of the path from a leaf to the root, Left tells if the sibling hash goes on the left side
+type MerkleProofNode struct {
+	Hash []byte
+	Left bool
+}
+
 /*
 	Since a merkel tree needs even nodes or leafs we make sure that we will always
 	have left and right nodes
@@ -38,17 +47,17 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
 
-	// We make sure that the data is even, if not duplicate the last entry
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
-	}
-
 	for _, dat := range data {
 		node := NewMerkleNode(nil, nil, dat)
 		nodes = append(nodes, *node)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
+	// Every level must be even, if it is not we duplicate the last node of the level
+	for {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
 		var level []MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
@@ -57,9 +66,70 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 		}
 
 		nodes = level
+
+		if len(nodes) == 1 {
+			break
+		}
 	}
 
 	tree := MerkleTree{&nodes[0]}
 
 	return &tree
 }
+
+/*
+	The proof of a leaf is the list of sibling hashes needed to rebuild the root from that leaf,
+	it is built level by level in the same way as the tree so both of them always agree
+*/
+func NewMerkleProof(data [][]byte, index int) []MerkleProofNode {
+	var proof []MerkleProofNode
+	var level [][]byte
+
+	for _, dat := range data {
+		hash := sha256.Sum256(dat)
+		level = append(level, hash[:])
+	}
+
+	for {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		if index%2 == 0 {
+			proof = append(proof, MerkleProofNode{level[index+1], false})
+		} else {
+			proof = append(proof, MerkleProofNode{level[index-1], true})
+		}
+
+		var next [][]byte
+		for j := 0; j < len(level); j += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[j]...), level[j+1]...))
+			next = append(next, hash[:])
+		}
+
+		level = next
+		index /= 2
+
+		if len(level) == 1 {
+			break
+		}
+	}
+
+	return proof
+}
+
+func VerifyMerkleProof(data []byte, proof []MerkleProofNode, root []byte) bool {
+	hash := sha256.Sum256(data)
+	current := hash[:]
+
+	for _, node := range proof {
+		if node.Left {
+			hash = sha256.Sum256(append(append([]byte{}, node.Hash...), current...))
+		} else {
+			hash = sha256.Sum256(append(append([]byte{}, current...), node.Hash...))
+		}
+		current = hash[:]
+	}
+
+	return bytes.Equal(current, root)
+}
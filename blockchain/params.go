@@ -0,0 +1,47 @@
+package blockchain
+
+/*
+	The regtest chain is a chain for tests on a single machine. Its genesis block pays to an address
+	whose public key hash is all zeros, which nobody can spend, so every node builds the same genesis
+*/
+const RegtestAddress = "1111111111111111111114oLvT2"
+
+// A UTXO set snapshot trusted by the node, loadutxo only accepts snapshots pinned here
+type SnapshotParams struct {
+	Height    int
+	BlockHash string // Hex of the hash of the block at that height
+	UTXOHash  string // Hex of the hash of the UTXO set after that block, as printed by dumputxo
+}
+
+/*
+	Snapshots pinned in the chain parameters. A new entry must be taken from a node we trust, so
+	the hash printed by dumputxo is checked against it before a node is bootstrapped from a file.
+	The entry of the regtest genesis is the one printed by dumputxo -height 0 on a regtest chain
+*/
+var AssumeUTXO = []SnapshotParams{
+	{
+		Height:    0,
+		BlockHash: "000037eeac04245ef3fbd528d45bd273e172113501b06ff06a87d98d2e4342e5",
+		UTXOHash:  "ae267a578766cfc3d6bf57e16f1961407f95cc456a02e629f074743be5f7a6dc",
+	},
+}
+
+// The genesis block of the regtest chain, it is the same on every node
+func RegtestGenesis() (*Block, error) {
+	cbtx, err := CoinbaseTx(RegtestAddress, genesisData)
+	if err != nil {
+		return nil, err
+	}
+
+	return Genesis(cbtx), nil
+}
+
+func findSnapshotParams(height int) (SnapshotParams, bool) {
+	for _, params := range AssumeUTXO {
+		if params.Height == height {
+			return params, true
+		}
+	}
+
+	return SnapshotParams{}, false
+}
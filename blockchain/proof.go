@@ -38,18 +38,25 @@ func NewProof(block *Block) *ProofOfWork {
 }
 
 func (pow *ProofOfWork) InitData(nonce int) []byte {
+	return PowData(pow.HeaderPrefix(), int64(nonce), Difficulty)
+}
+
+// The part of the data hashed that doesn't change with the nonce, it is all a miner needs from the block
+func (pow *ProofOfWork) HeaderPrefix() []byte {
 	// Takes 2 dimensional slice of bytes and combine them with an empty slice of bytes
-	data := bytes.Join(
+	return bytes.Join(
 		[][]byte{
 			pow.Block.PrevHash,
-			pow.Block.HashTransaction(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
+			pow.Block.MerkleRootHash(),
+			pow.Block.UTXORoot, // Empty on old blocks, so their proof of work is still valid
 		},
 		[]byte{},
 	)
+}
 
-	return data
+// The data hashed for a nonce, so a miner outside the node hashes exactly what the node checks
+func PowData(prefix []byte, nonce int64, difficulty int) []byte {
+	return bytes.Join([][]byte{prefix, ToHex(nonce), ToHex(int64(difficulty))}, []byte{})
 }
 
 // Create the hash based on the previous hash, the data and nonce from the block and the difficulty
@@ -83,15 +90,20 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
-	data := pow.InitData(pow.Block.Nonce)
-
-	hash := sha256.Sum256(data)
-	intHash.SetBytes(hash[:])
+	hash := pow.Hash()
+	intHash.SetBytes(hash)
 
 	return intHash.Cmp(pow.Target) == -1
 
 }
 
+// The hash of the block with its current nonce
+func (pow *ProofOfWork) Hash() []byte {
+	hash := sha256.Sum256(pow.InitData(pow.Block.Nonce))
+
+	return hash[:]
+}
+
 func ToHex(num int64) []byte {
 	buff := new(bytes.Buffer)
 	err := binary.Write(buff, binary.BigEndian, num)
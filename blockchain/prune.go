@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/blockchain-app-go/storage"
+)
+
+// Nodes in pruning mode keep at least this number of full blocks below the tip
+const MinPruneDepth = 10
+
+var (
+	prunedKey           = []byte("pruned") // Height of the highest block whose transactions were deleted
+	ErrBlockPruned      = errors.New("Block is pruned")
+	ErrUndoNotAvailable = errors.New("Undo data is not available")
+	ErrChainPruned      = errors.New("Cannot rebuild the UTXO set of a pruned chain")
+)
+
+// Returns the height of the highest pruned block, or -1 when no block has been pruned
+func (chain *Blockchain) PrunedHeight() (int, error) {
+	value, err := chain.Database.Get(prunedKey)
+	if err == storage.ErrNotFound {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return int(binary.BigEndian.Uint64(value)), nil
+}
+
+func (chain *Blockchain) IsPruned() (bool, error) {
+	height, err := chain.PrunedHeight()
+
+	return height >= 0, err
+}
+
+/*
+	Pruning replaces the blocks that are more than keep blocks below the tip by their headers and
+	deletes their undo data. The UTXO set, the headers and the recent blocks are all we need to
+	validate new blocks, so the node keeps working while using much less space. Blocks are pruned
+	from the tip down until we find one that was already pruned
+*/
+func (chain *Blockchain) Prune(keep int) (int, error) {
+	if keep < MinPruneDepth {
+		return 0, fmt.Errorf("Prune depth must be at least %d blocks", MinPruneDepth)
+	}
+
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := bestHeight - keep
+	if cutoff < 0 {
+		return 0, nil
+	}
+
+	var blocks []*Block
+	iter := &BlockchainIterator{chain.lastHash, chain.Database}
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		if block.Height <= cutoff {
+			if block.IsPruned() {
+				break
+			}
+			blocks = append(blocks, block)
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	prunedHeight, err := chain.PrunedHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, block := range blocks {
+		err := chain.Database.Update(func(batch storage.Batch) error {
+			if err := batch.Put(block.Hash, block.Header().Serialize()); err != nil {
+				return err
+			}
+			if err := batch.Delete(append(undoPrefix, block.Hash...)); err != nil {
+				return err
+			}
+			if block.Height > prunedHeight {
+				prunedHeight = block.Height
+				return batch.Put(prunedKey, ToHex(int64(block.Height)))
+			}
+			return nil
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(blocks), nil
+}
+
+// Returns the headers of all the blocks in the chain from the genesis to the tip
+func (chain *Blockchain) GetHeaders() ([]*Block, error) {
+	return chain.headersFrom(chain.LastHash())
+}
+
+func (chain *Blockchain) headersFrom(tip []byte) ([]*Block, error) {
+	var headers []*Block
+
+	iter := &BlockchainIterator{tip, chain.Database}
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		headers = append([]*Block{block.Header()}, headers...)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,85 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Mines count blocks on top of the chain, each with only a coinbase paying to address
+func mineTestBlocks(t *testing.T, chain *Blockchain, address string, count int) []*Block {
+	t.Helper()
+
+	var blocks []*Block
+	for i := 0; i < count; i++ {
+		blocks = append(blocks, mineTestBlock(t, chain, newCoinbase(t, address, 0)))
+	}
+
+	return blocks
+}
+
+func TestPrunedChainReorg(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	genesis := newTestGenesis(t, string(alice.Address()))
+	chain := newTestChainFrom(t, genesis)
+	deep := newTestChainFrom(t, genesis)
+	source := newTestChainFrom(t, genesis)
+
+	for _, block := range mineTestBlocks(t, source, string(alice.Address()), 2) {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, block := range mineTestBlocks(t, deep, string(alice.Address()), 1) {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mineTestBlocks(t, chain, string(bob.Address()), MinPruneDepth)
+	if _, err := chain.Prune(MinPruneDepth); err != nil {
+		t.Fatal(err)
+	}
+	if height, err := chain.PrunedHeight(); err != nil || height != 2 {
+		t.Fatalf("Pruned height is %d, %v", height, err)
+	}
+
+	// The fork is the highest pruned block, every block above it can still be reverted
+	for _, block := range mineTestBlocks(t, source, string(alice.Address()), MinPruneDepth+1) {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("Block %d: %s", block.Height, err)
+		}
+	}
+	if !bytes.Equal(chain.LastHash(), source.LastHash()) {
+		t.Fatal("The pruned chain didn't switch to the longer branch")
+	}
+	got, err := UTXOSet{chain}.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := UTXOSet{source}.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatal("The UTXO set differs from the one of the longer branch")
+	}
+
+	// A branch forking below the pruned blocks is refused before anything is stored
+	blocks := mineTestBlocks(t, deep, string(alice.Address()), MinPruneDepth+3)
+	for _, block := range blocks[:len(blocks)-1] {
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatalf("Block %d: %s", block.Height, err)
+		}
+	}
+	last := blocks[len(blocks)-1]
+	if err := chain.AddBlock(last); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("Branch forking below the pruned blocks returned %v", err)
+	}
+	if _, err := chain.GetBlock(last.Hash); !errors.Is(err, ErrNotFound) {
+		t.Fatal("The block of the branch was stored")
+	}
+	if !bytes.Equal(chain.LastHash(), source.LastHash()) {
+		t.Fatal("The tip moved")
+	}
+}
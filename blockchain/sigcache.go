@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/blockchain-app-go/wallet"
+)
+
+const maxSigCacheEntries = 50000
+
+/*
+	The signature cache remembers the (key type, digest, public key, signature) that were already
+	verified, for example when a transaction entered the memory pool, so when the same transaction
+	arrives inside of a block we don't need to check its signatures again. The cache is bounded,
+	when it is full the oldest entry is evicted
+*/
+type SigCache struct {
+	mutex      sync.RWMutex
+	entries    map[[32]byte]struct{}
+	order      [][32]byte
+	next       int
+	maxEntries int
+}
+
+func NewSigCache(maxEntries int) *SigCache {
+	return &SigCache{
+		entries:    make(map[[32]byte]struct{}, maxEntries),
+		order:      make([][32]byte, 0, maxEntries),
+		maxEntries: maxEntries,
+	}
+}
+
+// Every field is prefixed with its length, so moving bytes from one field to the next changes the key
+func sigCacheKey(keyType wallet.KeyType, digest, pubKey, signature []byte) [32]byte {
+	data := []byte{byte(keyType)}
+	length := make([]byte, 4)
+	for _, field := range [][]byte{digest, pubKey, signature} {
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		data = append(append(data, length...), field...)
+	}
+
+	return sha256.Sum256(data)
+}
+
+func (cache *SigCache) Exists(keyType wallet.KeyType, digest, pubKey, signature []byte) bool {
+	if cache == nil {
+		return false
+	}
+
+	key := sigCacheKey(keyType, digest, pubKey, signature)
+
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	_, ok := cache.entries[key]
+
+	return ok
+}
+
+func (cache *SigCache) Add(keyType wallet.KeyType, digest, pubKey, signature []byte) {
+	if cache == nil || cache.maxEntries <= 0 {
+		return
+	}
+
+	key := sigCacheKey(keyType, digest, pubKey, signature)
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if _, ok := cache.entries[key]; ok {
+		return
+	}
+
+	if len(cache.order) < cache.maxEntries {
+		cache.order = append(cache.order, key)
+	} else {
+		delete(cache.entries, cache.order[cache.next])
+		cache.order[cache.next] = key
+		cache.next = (cache.next + 1) % cache.maxEntries
+	}
+	cache.entries[key] = struct{}{}
+}
+
+func (cache *SigCache) Len() int {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	return len(cache.entries)
+}
@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/blockchain-app-go/wallet"
+)
+
+/*
+	The signature hash type tells which parts of the transaction are covered by a signature:
+	ALL signs every input and output, NONE signs the inputs but none of the outputs and SINGLE
+	signs the inputs and only the output with the same index as the signed input. ANYONECANPAY
+	can be added to any of them so only the signed input is covered and anyone can add more inputs
+*/
+type SigHashType byte
+
+const (
+	SigHashAll          SigHashType = 0x01
+	SigHashNone         SigHashType = 0x02
+	SigHashSingle       SigHashType = 0x03
+	SigHashAnyoneCanPay SigHashType = 0x80
+)
+
+func (hashType SigHashType) base() SigHashType {
+	return hashType &^ SigHashAnyoneCanPay
+}
+
+func (hashType SigHashType) IsValid() bool {
+	base := hashType.base()
+	return base == SigHashAll || base == SigHashNone || base == SigHashSingle
+}
+
+func (hashType SigHashType) String() string {
+	var name string
+
+	switch hashType.base() {
+	case SigHashAll:
+		name = "ALL"
+	case SigHashNone:
+		name = "NONE"
+	case SigHashSingle:
+		name = "SINGLE"
+	default:
+		name = fmt.Sprintf("0x%02x", byte(hashType.base()))
+	}
+
+	if hashType&SigHashAnyoneCanPay != 0 {
+		name += "|ANYONECANPAY"
+	}
+
+	return name
+}
+
+// Parses names like ALL, SINGLE or NONE|ANYONECANPAY
+func ParseSigHashType(name string) (SigHashType, error) {
+	var hashType SigHashType
+
+	for _, part := range strings.Split(strings.ToUpper(name), "|") {
+		switch strings.TrimSpace(part) {
+		case "ALL":
+			hashType |= SigHashAll
+		case "NONE":
+			hashType |= SigHashNone
+		case "SINGLE":
+			hashType |= SigHashSingle
+		case "ANYONECANPAY":
+			hashType |= SigHashAnyoneCanPay
+		default:
+			return 0, fmt.Errorf("Unknown signature hash type %s", part)
+		}
+	}
+
+	if !hashType.IsValid() {
+		return 0, fmt.Errorf("Invalid signature hash type %s", name)
+	}
+
+	return hashType, nil
+}
+
+/*
+	The hash type is appended as the last byte of the signature. Signatures made before hash types
+	existed don't have it: they are 64 bytes long or shorter (P-256 and Ed25519) or plain DER, and
+	they are always ALL signatures whose digest does not commit to the hash type
+*/
+func splitSignature(signature []byte) (sig []byte, hashType SigHashType, legacy bool) {
+	length := len(signature)
+	isDER := length > 8 && signature[0] == 0x30 && int(signature[1]) == length-3
+
+	if length == wallet.SignatureLength+1 || isDER {
+		return signature[:length-1], SigHashType(signature[length-1]), false
+	}
+
+	return signature, SigHashAll, true
+}
+
+/*
+	Returns the digest signed by the input inIdx. It is computed over a trimmed copy of the
+	transaction where only the parts covered by the hash type are left
+*/
+func (tx *Transaction) SignatureHash(inIdx int, prevTxs map[string]Transaction, hashType SigHashType, legacy bool) ([]byte, error) {
+	if !hashType.IsValid() {
+		return nil, fmt.Errorf("Invalid signature hash type 0x%02x", byte(hashType))
+	}
+
+	txCopy := tx.TrimmedCopy()
+	in := txCopy.Inputs[inIdx]
+	prevTx := prevTxs[hex.EncodeToString(in.ID)]
+	if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+		return nil, fmt.Errorf("Output %x:%d: %w", in.ID, in.Out, ErrNotFound)
+	}
+	txCopy.Inputs[inIdx].PubKey = prevTx.Outputs[in.Out].PubKeyHash
+
+	switch hashType.base() {
+	case SigHashNone:
+		txCopy.Outputs = nil
+	case SigHashSingle:
+		if inIdx >= len(txCopy.Outputs) {
+			return nil, fmt.Errorf("Input %d: %w", inIdx, ErrNoSingleOutput)
+		}
+		txCopy.Outputs = []TxOutput{txCopy.Outputs[inIdx]}
+	}
+
+	if hashType&SigHashAnyoneCanPay != 0 {
+		txCopy.Inputs = []TxInput{txCopy.Inputs[inIdx]}
+	}
+
+	digest := txCopy.Hash()
+	if legacy {
+		return digest, nil
+	}
+
+	// Committing to the hash type stops anyone from changing it after the transaction is signed
+	hash := sha256.Sum256(append(digest, byte(hashType)))
+
+	return hash[:], nil
+}
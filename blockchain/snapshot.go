@@ -0,0 +1,271 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/blockchain-app-go/storage"
+)
+
+// All the unspent outputs of a transaction
+type UTXOEntry struct {
+	TxID    []byte
+	Outputs TxOutputs
+}
+
+/*
+	A snapshot is the UTXO set after the block at Height together with the headers of the chain up
+	to that block. It is enough to start a node without downloading and validating every block
+*/
+type UTXOSnapshot struct {
+	Height    int
+	BlockHash []byte
+	Headers   [][]byte
+	Entries   []UTXOEntry
+	Hash      []byte
+}
+
+func (snapshot UTXOSnapshot) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(snapshot)
+	HandleError(err)
+	return buffer.Bytes()
+}
+
+func DeserializeSnapshot(data []byte) (*UTXOSnapshot, error) {
+	var snapshot UTXOSnapshot
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&snapshot); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+/*
+	The hash of the UTXO set is computed over a fixed binary encoding of the entries sorted by
+	transaction ID, never over gob, so every node gets the same hash for the same set. The ID and
+	the outputs of every entry are prefixed with their length, so two different sets can't be
+	encoded to the same bytes
+*/
+func HashUTXOEntries(entries []UTXOEntry) []byte {
+	hasher := sha256.New()
+
+	for _, entry := range entries {
+		binary.Write(hasher, binary.BigEndian, uint32(len(entry.TxID)))
+		hasher.Write(entry.TxID)
+		binary.Write(hasher, binary.BigEndian, uint32(len(entry.Outputs.Outputs)))
+		for i, out := range entry.Outputs.Outputs {
+			hasher.Write(encodeUTXO(entry.Outputs.Index(i), out))
+		}
+	}
+
+	return hasher.Sum(nil)
+}
+
+func encodeUTXO(index int, out TxOutput) []byte {
+	var buffer bytes.Buffer
+
+	binary.Write(&buffer, binary.BigEndian, uint32(index))
+	binary.Write(&buffer, binary.BigEndian, int64(out.Value))
+	buffer.WriteByte(byte(out.KeyType))
+	buffer.WriteByte(byte(len(out.PubKeyHash)))
+	buffer.Write(out.PubKeyHash)
+
+	return buffer.Bytes()
+}
+
+// The store iterates the keys in order, so the entries are already sorted by transaction ID
+func (u UTXOSet) Entries() ([]UTXOEntry, error) {
+	var entries []UTXOEntry
+
+	err := u.Blockchain.Database.Iterate(utxoPrefix, func(k, v []byte) error {
+		txID := bytes.TrimPrefix(k, utxoPrefix)
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, UTXOEntry{txID, outs})
+		return nil
+	})
+
+	return entries, err
+}
+
+func (u UTXOSet) Hash() ([]byte, error) {
+	entries, err := u.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	return HashUTXOEntries(entries), nil
+}
+
+/*
+	Takes a snapshot of the UTXO set after the block at the height, a negative height takes it at the
+	tip. The set of an older block is rebuilt by reverting the blocks above it with their undo data,
+	so those blocks must not be pruned
+*/
+func (u UTXOSet) Snapshot(height int) (*UTXOSnapshot, error) {
+	chain := u.Blockchain
+	chain.mutex.RLock()
+	defer chain.mutex.RUnlock()
+
+	entries, err := u.Entries()
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]TxOutputs)
+	for _, entry := range entries {
+		set[hex.EncodeToString(entry.TxID)] = entry.Outputs
+	}
+
+	tip, err := chain.lastBlock()
+	if err != nil {
+		return nil, err
+	}
+	if height > tip.Height {
+		return nil, fmt.Errorf("The chain has no block at height %d, the tip is at %d", height, tip.Height)
+	}
+
+	block, err := chain.revertSet(set, func(block *Block) bool {
+		return height < 0 || block.Height <= height
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &UTXOSnapshot{Height: block.Height, BlockHash: block.Hash}
+
+	headers, err := chain.headersFrom(block.Hash)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		snapshot.Headers = append(snapshot.Headers, header.Serialize())
+	}
+
+	if snapshot.Entries, err = sortedEntries(set); err != nil {
+		return nil, err
+	}
+	snapshot.Hash = HashUTXOEntries(snapshot.Entries)
+
+	return snapshot, nil
+}
+
+/*
+	Checks that the headers are linked, have a valid proof of work and end in the snapshot block,
+	that the entries match the hash of the snapshot and that the hash is pinned in the chain parameters
+*/
+func (snapshot *UTXOSnapshot) Verify() error {
+	var prevHash []byte
+	var last *Block
+
+	for height, data := range snapshot.Headers {
+		header, err := Deserialize(data)
+		if err != nil {
+			return err
+		}
+		// The hash is where the header is stored and what the next one links to, so it must be the one of its proof of work
+		pow := NewProof(header)
+		if header.Height != height || !bytes.Equal(header.PrevHash, prevHash) || !pow.Validate() || !bytes.Equal(pow.Hash(), header.Hash) {
+			return fmt.Errorf("Invalid header %x at height %d", header.Hash, height)
+		}
+		prevHash = header.Hash
+		last = header
+	}
+
+	if last == nil || last.Height != snapshot.Height || !bytes.Equal(last.Hash, snapshot.BlockHash) {
+		return errors.New("Headers don't end in the snapshot block")
+	}
+
+	if !bytes.Equal(HashUTXOEntries(snapshot.Entries), snapshot.Hash) {
+		return errors.New("UTXO entries don't match the snapshot hash")
+	}
+
+	if len(last.UTXORoot) > 0 && !bytes.Equal(UTXOCommitment(snapshot.Entries), last.UTXORoot) {
+		return errors.New("UTXO entries don't match the commitment of the snapshot block")
+	}
+
+	params, ok := findSnapshotParams(snapshot.Height)
+	if !ok {
+		return fmt.Errorf("No snapshot pinned in the chain parameters at height %d", snapshot.Height)
+	}
+	if params.BlockHash != hex.EncodeToString(snapshot.BlockHash) || params.UTXOHash != hex.EncodeToString(snapshot.Hash) {
+		return fmt.Errorf("Snapshot doesn't match the one pinned in the chain parameters at height %d", snapshot.Height)
+	}
+
+	return nil
+}
+
+/*
+	Creates the database of a new node from a verified snapshot. The headers are stored like pruned
+	blocks, so the node works as a pruned node whose tip is the snapshot block
+*/
+func LoadSnapshot(snapshot *UTXOSnapshot, nodeId string) (*Blockchain, error) {
+	if ChainExists(nodeId) {
+		return nil, ErrChainExists
+	}
+
+	var keys, values [][]byte
+	for _, data := range snapshot.Headers {
+		header, err := Deserialize(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, header.Hash)
+		values = append(values, data)
+	}
+	for _, entry := range snapshot.Entries {
+		keys = append(keys, append(utxoPrefix, entry.TxID...))
+		values = append(values, entry.Outputs.Serialize())
+	}
+
+	db, err := createDb(nodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Big sets don't fit in a single badger transaction so they are written in batches
+	const batchSize = 1000
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		err = db.Update(func(batch storage.Batch) error {
+			for i := start; i < end; i++ {
+				if err := batch.Put(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// The tip is only set once everything else is written
+	err = db.Update(func(batch storage.Batch) error {
+		if err := batch.Put(prunedKey, ToHex(int64(snapshot.Height))); err != nil {
+			return err
+		}
+		return batch.Put(lastHashKey, snapshot.BlockHash)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newChain(snapshot.BlockHash, db), nil
+}
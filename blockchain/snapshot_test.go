@@ -0,0 +1,42 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSnapshotVerifyChecksHeaderHashes(t *testing.T) {
+	w := newTestWallet(t)
+	chain := newTestChain(t, string(w.Address()))
+	mineTestBlock(t, chain, newCoinbase(t, string(w.Address()), 0))
+	mineTestBlock(t, chain, newCoinbase(t, string(w.Address()), 0))
+
+	snapshot, err := UTXOSet{chain}.Snapshot(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(pinned []SnapshotParams) { AssumeUTXO = pinned }(AssumeUTXO)
+	AssumeUTXO = append(AssumeUTXO, SnapshotParams{snapshot.Height, hex.EncodeToString(snapshot.BlockHash), hex.EncodeToString(snapshot.Hash)})
+	if err := snapshot.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A header with a valid proof of work of its own, claiming the hash of the pinned block
+	last := len(snapshot.Headers) - 1
+	forged, err := Deserialize(snapshot.Headers[last])
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.MerkleRoot = make([]byte, len(forged.MerkleRoot))
+	solve(forged)
+	forged.Hash = snapshot.BlockHash
+	if !NewProof(forged).Validate() {
+		t.Fatal("The forged header has no valid proof of work")
+	}
+
+	tampered := *snapshot
+	tampered.Headers = append(append([][]byte{}, snapshot.Headers[:last]...), forged.Serialize())
+	if err := tampered.Verify(); err == nil {
+		t.Fatal("Snapshot with a header whose hash is not its own was accepted")
+	}
+}
@@ -2,15 +2,13 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/big"
 	"strings"
 
 	"github.com/blockchain-app-go/wallet"
@@ -22,6 +20,17 @@ type Transaction struct {
 	Outputs []TxOutput
 }
 
+/*
+	Gob numbers the types in the order a process encodes them for the first time and those numbers
+	are part of the encoded bytes. Transaction hashes and signatures are computed over those bytes,
+	so we encode a transaction as soon as the package is loaded to give its types the same numbers
+	in every process, no matter what the process encodes later. They are the numbers of a process
+	that encodes a transaction first, like the one of a wallet sending it
+*/
+func init() {
+	HandleError(gob.NewEncoder(ioutil.Discard).Encode(Transaction{}))
+}
+
 func (tx Transaction) Serialize() []byte {
 	var encoded bytes.Buffer
 
@@ -46,67 +55,264 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
-func DeserializeTransaction(data []byte) Transaction {
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
-	HandleError(err)
-	return transaction
+
+	return transaction, err
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+// Coins created by the coinbase of every block, on top of the fees of its transactions
+const Subsidy = 20
+
+func CoinbaseTx(to, data string) (*Transaction, error) {
+	return CoinbaseTxWithFees(to, data, 0)
+}
+
+// The coinbase of a block whose transactions pay fees, the miner gets them together with the subsidy
+func CoinbaseTxWithFees(to, data string, fees int) (*Transaction, error) {
 	if data == "" {
 		randData := make([]byte, 24)
-		_, err := rand.Read(randData)
-		HandleError(err)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
 
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txIn := TxInput{[]byte{}, -1, nil, []byte(data)} // Since is not referecing to any Output the ID is empty and the OUT int -1
-	txOut := NewTxOutput(20, to)
+	txIn := TxInput{[]byte{}, -1, nil, []byte(data), false} // Since is not referecing to any Output the ID is empty and the OUT int -1
+	txOut, err := NewTxOutput(Subsidy+fees, to)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := Transaction{nil, []TxInput{txIn}, []TxOutput{*txOut}}
 	tx.ID = tx.Hash()
 
-	return &tx
+	return &tx, nil
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// Builds the inputs spending outputs of the wallet worth at least amount, it returns their total value
+func spendableInputs(w *wallet.Wallet, amount int, replaceable bool, UTXO UTXOView) ([]TxInput, int, error) {
 	var inputs []TxInput
-	var outputs []TxOutput
 
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	accumulated, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	accumulated, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	if accumulated < amount {
-		log.Panic("Error: not enough funds")
+		return nil, 0, ErrInsufficientFunds
 	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-		HandleError(err)
+		if err != nil {
+			return nil, 0, err
+		}
 
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+			input := TxInput{txID, out, nil, w.PublicKey, replaceable}
 			inputs = append(inputs, input)
 		}
 	}
 
+	return inputs, accumulated, nil
+}
+
+// The fee is left out of the outputs, the change is what remains of the inputs after the amount and the fee
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO UTXOView) (*Transaction, error) {
+	return newTransaction(w, to, amount, fee, false, UTXO)
+}
+
+// Same as NewTransaction, but the transaction signals that it can be replaced until it is mined
+func NewReplaceableTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO UTXOView) (*Transaction, error) {
+	return newTransaction(w, to, amount, fee, true, UTXO)
+}
+
+func newTransaction(w *wallet.Wallet, to string, amount, fee int, replaceable bool, UTXO UTXOView) (*Transaction, error) {
+	var outputs []TxOutput
+
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: negative fee", ErrInvalidTransaction)
+	}
+	inputs, accumulated, err := spendableInputs(w, amount+fee, replaceable, UTXO)
+	if err != nil {
+		return nil, err
+	}
+
 	from := fmt.Sprintf("%s", w.Address())
 
-	outputs = append(outputs, *NewTxOutput(amount, to))
+	out, err := NewTxOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *out)
+
+	if accumulated > amount+fee {
+		change, err := NewTxOutput(accumulated-amount-fee, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
+	}
+
+	tx := Transaction{nil, inputs, outputs}
+	tx.ID = tx.Hash()
+	if err := signInView(&tx, w, UTXO); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+// The previous transactions come from the view, so the inputs can spend unconfirmed outputs
+func signInView(tx *Transaction, w *wallet.Wallet, UTXO UTXOView) error {
+	prevTxs, err := UTXO.GetPreviousTransactions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Sign(w, prevTxs)
+}
+
+/*
+	A data transaction embeds the data in an unspendable output. It still needs at least one input
+	signed by the wallet so the whole value of the inputs is sent back to the wallet as change
+*/
+func NewDataTransaction(w *wallet.Wallet, data []byte, UTXO UTXOView) (*Transaction, error) {
+	var outputs []TxOutput
 
-	if accumulated > amount {
-		outputs = append(outputs, *NewTxOutput(accumulated-amount, from))
+	if len(data) > MaxDataCarrierSize {
+		return nil, fmt.Errorf("%w of %d bytes", ErrDataTooLarge, MaxDataCarrierSize)
+	}
+
+	inputs, accumulated, err := spendableInputs(w, 1, false, UTXO)
+	if err != nil {
+		return nil, err
+	}
+
+	from := fmt.Sprintf("%s", w.Address())
+
+	change, err := NewTxOutput(accumulated, from)
+	if err != nil {
+		return nil, err
 	}
+	outputs = append(outputs, *NewDataOutput(data))
+	outputs = append(outputs, *change)
 
 	tx := Transaction{nil, inputs, outputs}
 	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	if err := signInView(&tx, w, UTXO); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+/*
+	Builds a replacement of a replaceable transaction of the wallet that pays fee instead. It spends
+	the same inputs and the extra fee is taken from the change, the last output paying the wallet
+*/
+func BumpFee(w *wallet.Wallet, tx *Transaction, fee int, UTXO UTXOView) (*Transaction, error) {
+	if !tx.IsReplaceable() {
+		return nil, fmt.Errorf("Transaction %x doesn't signal that it can be replaced", tx.ID)
+	}
+
+	prevTxs, err := UTXO.GetPreviousTransactions(tx)
+	if err != nil {
+		return nil, err
+	}
+	oldFee, err := tx.Fee(prevTxs)
+	if err != nil {
+		return nil, err
+	}
+	if fee <= oldFee {
+		return nil, fmt.Errorf("%w of %d", ErrFeeTooLow, oldFee)
+	}
+
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	var inputs []TxInput
+	for _, in := range tx.Inputs {
+		if !in.UsesKey(pubKeyHash) {
+			return nil, fmt.Errorf("Transaction %x spends outputs of another wallet", tx.ID)
+		}
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, w.PublicKey, true})
+	}
 
-	return &tx
+	outputs := append([]TxOutput{}, tx.Outputs...)
+	change := -1
+	for i, out := range outputs {
+		if !out.IsDataCarrier() && out.IsLockedWithKey(pubKeyHash) {
+			change = i
+		}
+	}
+	if change < 0 || outputs[change].Value <= fee-oldFee {
+		return nil, fmt.Errorf("%w: the change can't pay the new fee", ErrInsufficientFunds)
+	}
+	outputs[change].Value -= fee - oldFee
+
+	replacement := Transaction{nil, inputs, outputs}
+	replacement.ID = replacement.Hash()
+	if err := replacement.Sign(w, prevTxs); err != nil {
+		return nil, err
+	}
+
+	return &replacement, nil
+}
+
+// A transaction is replaceable when any of its inputs signals it
+func (tx *Transaction) IsReplaceable() bool {
+	for _, in := range tx.Inputs {
+		if in.Replaceable {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (tx *Transaction) OutputValue() int {
+	value := 0
+	for _, out := range tx.Outputs {
+		value += out.Value
+	}
+
+	return value
+}
+
+// Value of the inputs not spent by the outputs
+func (tx *Transaction) Fee(prevTxs map[string]Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	fee := 0
+	for _, in := range tx.Inputs {
+		prevTx, ok := prevTxs[hex.EncodeToString(in.ID)]
+		if !ok || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return 0, fmt.Errorf("Output %x:%d: %w", in.ID, in.Out, ErrNotFound)
+		}
+		fee += prevTx.Outputs[in.Out].Value
+	}
+
+	return fee - tx.OutputValue(), nil
+}
+
+// Returns the payloads of all the data-carrier outputs of the transaction
+func (tx *Transaction) Data() [][]byte {
+	var data [][]byte
+
+	for _, out := range tx.Outputs {
+		if out.IsDataCarrier() {
+			data = append(data, out.Data)
+		}
+	}
+
+	return data
 }
 
 func (tx *Transaction) IsCoinbase() bool {
@@ -114,31 +320,50 @@ func (tx *Transaction) IsCoinbase() bool {
 }
 
 // The way to sign the transaction is thorugh the input by accessing to the reference outputs of them
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTxs map[string]Transaction) {
+func (tx *Transaction) Sign(w *wallet.Wallet, prevTxs map[string]Transaction) error {
+	return tx.SignWithHashType(w, prevTxs, SigHashAll)
+}
+
+/*
+	Signs every input of the transaction with the given signature hash type. A SINGLE signature needs
+	an output with the index of each input, otherwise no input is signed and ErrNoSingleOutput is returned
+*/
+func (tx *Transaction) SignWithHashType(w *wallet.Wallet, prevTxs map[string]Transaction, hashType SigHashType) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	if !tx.checkIfInputsExists(prevTxs) {
-		log.Panic("ERROR: Previous transaction does not exist")
+		return fmt.Errorf("Previous transaction: %w", ErrNotFound)
+	}
+	if hashType.base() == SigHashSingle && len(tx.Inputs) > len(tx.Outputs) {
+		return fmt.Errorf("%w: %d inputs and %d outputs", ErrNoSingleOutput, len(tx.Inputs), len(tx.Outputs))
 	}
 
-	txCopy := tx.TrimmedCopy()
-
-	for inId, in := range txCopy.Inputs {
-		prevTX := prevTxs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
+	for inId := range tx.Inputs {
+		if err := tx.SignInput(inId, w, prevTxs, hashType); err != nil {
+			return err
+		}
+	}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		HandleError(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+	return nil
+}
 
-		tx.Inputs[inId].Signature = signature
+// The hash type is appended to the signature so the verifier can rebuild the same digest
+func (tx *Transaction) SignInput(inIdx int, w *wallet.Wallet, prevTxs map[string]Transaction, hashType SigHashType) error {
+	digest, err := tx.SignatureHash(inIdx, prevTxs, hashType, false)
+	if err != nil {
+		return err
+	}
 
+	signature, err := w.Sign(digest)
+	if err != nil {
+		return err
 	}
+
+	tx.Inputs[inIdx].Signature = append(signature, byte(hashType))
+
+	return nil
 }
 
 func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
@@ -146,42 +371,54 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 		return true
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTxs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous transaction not correct")
-		}
+	if !tx.checkIfInputsExists(prevTxs) {
+		return false
 	}
 
-	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
-
 	// We want to iterate through each of our Outputs and check the signature on each of them
-	for inId, in := range tx.Inputs {
-		prevTx := prevTxs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inId].PubKey = nil
-
-		// We unpack the signature data to the pair of numbers
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
-
-		// We unpack the public key data to the pair of coordinates
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
-
-		rawPublicKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPublicKey, txCopy.ID, &r, &s) == false {
+	for inId := range tx.Inputs {
+		if !tx.VerifyInput(inId, prevTxs, nil, false) {
 			return false
 		}
+	}
 
+	return true
+}
+
+/*
+	Verifies the signature of a single input. When a signature cache is given the signatures found
+	in it are not checked again and, if store is set, the ones that are valid are added to it
+*/
+func (tx *Transaction) VerifyInput(inIdx int, prevTxs map[string]Transaction, cache *SigCache, store bool) bool {
+	in := tx.Inputs[inIdx]
+	prevTx := prevTxs[hex.EncodeToString(in.ID)]
+	if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+		return false
+	}
+	prevOut := prevTx.Outputs[in.Out]
+
+	// Data-carrier outputs are unspendable and the rest can only be unlocked by the owner of the key
+	if prevOut.IsDataCarrier() || !in.UsesKey(prevOut.PubKeyHash) {
+		return false
+	}
+
+	signature, hashType, legacy := splitSignature(in.Signature)
+	digest, err := tx.SignatureHash(inIdx, prevTxs, hashType, legacy)
+	if err != nil {
+		return false
+	}
+
+	if cache.Exists(prevOut.KeyType, digest, in.PubKey, in.Signature) {
+		return true
+	}
+
+	// The key type of the output we are spending tells which signature scheme was used
+	if wallet.Verify(prevOut.KeyType, in.PubKey, digest, signature) == false {
+		return false
+	}
+
+	if store {
+		cache.Add(prevOut.KeyType, digest, in.PubKey, in.Signature)
 	}
 
 	return true
@@ -202,11 +439,11 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil}) // we creal the pubkey and the signature
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil, in.Replaceable}) // we creal the pubkey and the signature
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash, out.Data, out.KeyType})
 	}
 
 	txCopy := Transaction{tx.ID, inputs, outputs}
@@ -224,12 +461,18 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
 		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
 		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		if input.Replaceable {
+			lines = append(lines, "       Replaceable")
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
 		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		if output.IsDataCarrier() {
+			lines = append(lines, fmt.Sprintf("       Data:   %x", output.Data))
+		}
 	}
 
 	return strings.Join(lines, "\n")
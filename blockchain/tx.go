@@ -7,20 +7,34 @@ import (
 	"github.com/blockchain-app-go/wallet"
 )
 
+/*
+	Largest payload of a data-carrier output in a valid transaction. It is a consensus rule, so it is
+	the same for every node, each node can only relay and mine smaller payloads with its memory pool
+*/
+const MaxDataCarrierSize = 80
+
 type TxOutput struct {
 	Value      int
 	PubKeyHash []byte
+	Data       []byte         // Payload of a data-carrier output, which is not locked to any key
+	KeyType    wallet.KeyType // Signature scheme of the key, taken from the version byte of the address
 }
 
+/*
+	The UTXO set does not keep every output of a transaction, spent and data-carrier outputs are
+	left out, so we store next to each output the position it has inside of its transaction
+*/
 type TxOutputs struct {
 	Outputs []TxOutput
+	Indexes []int
 }
 
 type TxInput struct {
-	ID        []byte
-	Out       int
-	Signature []byte
-	PubKey    []byte
+	ID          []byte
+	Out         int
+	Signature   []byte
+	PubKey      []byte
+	Replaceable bool // The transaction can be replaced in the memory pool by one paying a higher fee
 }
 
 func (in TxInput) UsesKey(pubKeyHash []byte) bool {
@@ -29,21 +43,45 @@ func (in TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+func (out *TxOutput) Lock(address []byte) error {
+	keyType, pubKeyHash, err := wallet.DecodeAddress(string(address))
+	if err != nil {
+		return err
+	}
+	out.KeyType = keyType
 	out.PubKeyHash = pubKeyHash
+
+	return nil
 }
 
 func (out TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 	return bytes.Equal(out.PubKeyHash, pubKeyHash)
 }
 
-func NewTxOutput(value int, address string) *TxOutput {
-	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
+// Data-carrier outputs have no public key hash so no input can ever unlock them, they must carry no value
+func (out TxOutput) IsDataCarrier() bool {
+	return len(out.PubKeyHash) == 0
+}
 
-	return txo
+func NewTxOutput(value int, address string) (*TxOutput, error) {
+	txo := &TxOutput{value, nil, nil, wallet.P256}
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
+
+	return txo, nil
+}
+
+func NewDataOutput(data []byte) *TxOutput {
+	return &TxOutput{0, nil, data, wallet.P256}
+}
+
+// Returns the position inside of its transaction of the i-th output of the set
+func (outputs TxOutputs) Index(i int) int {
+	if outputs.Indexes == nil {
+		return i
+	}
+	return outputs.Indexes[i]
 }
 
 func (outputs TxOutputs) Serialize() []byte {
@@ -54,12 +92,11 @@ func (outputs TxOutputs) Serialize() []byte {
 	return buffer.Bytes()
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
 	var outputs TxOutputs
 
 	decode := gob.NewDecoder(bytes.NewReader(data))
 	err := decode.Decode(&outputs)
-	HandleError(err)
 
-	return outputs
+	return outputs, err
 }
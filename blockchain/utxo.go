@@ -2,15 +2,17 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/gob"
 	"encoding/hex"
-	"log"
+	"fmt"
 
-	"github.com/dgraph-io/badger"
+	"github.com/blockchain-app-go/storage"
 )
 
-// Since badgerDB doesn't have tables we use prefexes to separate data within the database
+// Since the store doesn't have tables we use prefexes to separate data within the database
 var (
 	utxoPrefix   = []byte("utxo-")
+	undoPrefix   = []byte("undo-")
 	prefixLength = len(utxoPrefix)
 )
 
@@ -18,100 +20,179 @@ type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
+/*
+	The outputs new transactions can spend. The UTXO set only has the confirmed outputs, a memory
+	pool adds the outputs of its transactions on top of it and hides the outputs they spend
+*/
+type UTXOView interface {
+	FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error)
+	GetPreviousTransactions(tx *Transaction) (map[string]Transaction, error)
+}
+
+// An output removed from the UTXO set when a block spent it
+type SpentOutput struct {
+	TxID   []byte
+	Index  int
+	Output TxOutput
+}
+
+/*
+	The undo data of a block are the outputs it spent. With them the changes of the block in the
+	UTXO set can be reverted, so it is kept for the blocks that could still be disconnected
+*/
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (undo BlockUndo) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(undo)
+	HandleError(err)
+	return buffer.Bytes()
+}
+
+func DeserializeUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&undo)
+
+	return undo, err
+}
+
 // Enables the creation of normal transactions which are not coinbase
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
 	db := u.Blockchain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			v, err := item.Value()
-			HandleError(err)
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
+	err := db.Iterate(utxoPrefix, func(k, v []byte) error {
+		k = bytes.TrimPrefix(k, utxoPrefix)
+		txID := hex.EncodeToString(k)
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for i, out := range outs.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
+				accumulated += out.Value
+				unspentOuts[txID] = append(unspentOuts[txID], outs.Index(i))
 			}
 		}
 		return nil
 	})
-	HandleError(err)
-	return accumulated, unspentOuts
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return accumulated, unspentOuts, nil
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
+func (u UTXOSet) GetPreviousTransactions(tx *Transaction) (map[string]Transaction, error) {
+	return u.Blockchain.GetPreviousTransactions(tx)
+}
 
-	db := u.Blockchain.Database
+// Returns all the outputs locked with the key, by the ID of their transaction
+func (u UTXOSet) FindUnspentOutputs(pubKeyHash []byte) (map[string]TxOutputs, error) {
+	unspentOuts := make(map[string]TxOutputs)
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	err := u.Blockchain.Database.Iterate(utxoPrefix, func(k, v []byte) error {
+		txID := hex.EncodeToString(bytes.TrimPrefix(k, utxoPrefix))
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+		for i, out := range outs.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) {
+				owned := unspentOuts[txID]
+				owned.Outputs = append(owned.Outputs, out)
+				owned.Indexes = append(owned.Indexes, outs.Index(i))
+				unspentOuts[txID] = owned
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			v, err := item.Value()
-			HandleError(err)
-			outs := DeserializeOutputs(v)
+	return unspentOuts, nil
+}
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
+	var UTXOs []TxOutput
+
+	db := u.Blockchain.Database
+
+	err := db.Iterate(utxoPrefix, func(k, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for _, out := range outs.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) {
+				UTXOs = append(UTXOs, out)
 			}
 		}
 
 		return nil
 	})
-	HandleError(err)
 
-	return UTXOs
+	return UTXOs, err
 }
 
-func (u UTXOSet) CountTransactions() int {
+func (u UTXOSet) CountTransactions() (int, error) {
 	db := u.Blockchain.Database
 	counter := 0
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			counter++
-		}
-
+	err := db.Iterate(utxoPrefix, func(k, v []byte) error {
+		counter++
 		return nil
 	})
 
-	HandleError(err)
+	return counter, err
+}
 
-	return counter
+// The UTXO set of a pruned chain can't be rebuilt since the old transactions are gone
+func (u UTXOSet) Reindex() error {
+	chain := u.Blockchain
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	return u.reindex(chain.lastHash)
 }
 
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.Database
+/*
+	Rebuilds the UTXO set for the chain ending in the block tip and moves the tip to it. Nothing is
+	changed if the chain of the block can't be read. The caller must hold the write lock
+*/
+func (u UTXOSet) reindex(tip []byte) error {
+	chain := u.Blockchain
+	db := chain.Database
+
+	pruned, err := chain.IsPruned()
+	if err != nil {
+		return err
+	}
+	if pruned {
+		return ErrChainPruned
+	}
 
-	u.DeleteByPrefix(utxoPrefix)
+	UTXO, err := chain.findUnspentTxO(tip)
+	if err != nil {
+		return err
+	}
 
-	UTXO := u.Blockchain.FindUnspentTxO()
+	chain.cacheTree(nil, nil)
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
+	err = db.Update(func(batch storage.Batch) error {
 		for txId, outs := range UTXO {
 			key, err := hex.DecodeString(txId)
 			if err != nil {
@@ -119,107 +200,357 @@ func (u UTXOSet) Reindex() {
 			}
 			key = append(utxoPrefix, key...)
 
-			err = txn.Set(key, outs.Serialize())
-			HandleError(err)
+			if err := batch.Put(key, outs.Serialize()); err != nil {
+				return err
+			}
 		}
 
-		return nil
+		return batch.Put(lastHashKey, tip)
 	})
-	HandleError(err)
+	if err != nil {
+		return err
+	}
+
+	chain.lastHash = tip
+
+	return nil
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.Blockchain.Database
+/*
+	Connects the block to the UTXO set, the subscribers of the chain are notified once it is written.
+	Blocks added with AddBlock or MineBlock are already connected, this is for blocks stored apart
+*/
+func (u *UTXOSet) Update(block *Block) error {
+	chain := u.Blockchain
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	err := chain.Database.Update(func(batch storage.Batch) error {
+		return updateUTXO(batch, block)
+	})
+	chain.cacheTree(nil, nil)
+	if err != nil {
+		return err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					HandleError(err)
-					v, err := item.Value()
-					HandleError(err)
-
-					outs := DeserializeOutputs(v)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+	chain.Events.Publish(Event{Type: BlockConnected, Block: block})
+
+	return nil
+}
+
+// Spends the inputs of the block and adds its outputs, the spent outputs are kept as its undo data
+func updateUTXO(batch storage.Batch, block *Block) error {
+	undo := BlockUndo{}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				updatedOuts := TxOutputs{}
+				inID := append(utxoPrefix, in.ID...)
+				v, err := batch.Get(inID)
+				if err == storage.ErrNotFound {
+					return fmt.Errorf("Output %x:%d: %w", in.ID, in.Out, ErrNotFound)
+				} else if err != nil {
+					return err
+				}
 
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
+				outs, err := DeserializeOutputs(v)
+				if err != nil {
+					return err
+				}
 
+				for i, out := range outs.Outputs {
+					if outs.Index(i) != in.Out {
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(i))
 					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
+						undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, out})
 					}
 				}
-			}
 
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+				if len(updatedOuts.Outputs) == 0 {
+					if err := batch.Delete(inID); err != nil {
+						return err
+					}
+
+				} else {
+					if err := batch.Put(inID, updatedOuts.Serialize()); err != nil {
+						return err
+					}
+				}
 			}
+		}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+		// Data-carrier outputs can never be spent so they don't belong to the UTXO set
+		newOutputs := TxOutputs{}
+		for outIdx, out := range tx.Outputs {
+			if out.IsDataCarrier() {
+				continue
 			}
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
 		}
 
-		return nil
+		txID := append(utxoPrefix, tx.ID...)
+		if err := batch.Put(txID, newOutputs.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return batch.Put(append(undoPrefix, block.Hash...), undo.Serialize())
+}
+
+/*
+	Reverts the changes of the block in the UTXO set with its undo data: the outputs created by the
+	block are removed and the outputs it spent are added back in their original positions
+*/
+func (u *UTXOSet) Undo(block *Block) error {
+	chain := u.Blockchain
+	chain.mutex.Lock()
+	defer chain.mutex.Unlock()
+
+	err := chain.Database.Update(func(batch storage.Batch) error {
+		return undoUTXO(batch, block)
 	})
-	HandleError(err)
+	chain.cacheTree(nil, nil)
+	if err != nil {
+		return err
+	}
+
+	chain.Events.Publish(Event{Type: BlockDisconnected, Block: block})
+
+	return nil
+}
+
+// Reverts the block in the batch, the undo data is deleted since the block is no longer connected
+func undoUTXO(batch storage.Batch, block *Block) error {
+	undoKey := append(undoPrefix, block.Hash...)
+	data, err := batch.Get(undoKey)
+	if err != nil {
+		return fmt.Errorf("Block %x: %w", block.Hash, ErrUndoNotAvailable)
+	}
+	undo, err := DeserializeUndo(data)
+	if err != nil {
+		return err
+	}
+
+	createdTxs := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		createdTxs[hex.EncodeToString(tx.ID)] = true
+		if err := batch.Delete(append(utxoPrefix, tx.ID...)); err != nil {
+			return err
+		}
+	}
+
+	for i := len(undo.Spent) - 1; i >= 0; i-- {
+		spent := undo.Spent[i]
+		// Outputs created and spent inside of the same block were never in the UTXO set before it
+		if createdTxs[hex.EncodeToString(spent.TxID)] {
+			continue
+		}
+		key := append(utxoPrefix, spent.TxID...)
+		outs := TxOutputs{}
+
+		if v, err := batch.Get(key); err == nil {
+			if outs, err = DeserializeOutputs(v); err != nil {
+				return err
+			}
+		}
+
+		if err := batch.Put(key, restoreOutput(outs, spent).Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return batch.Delete(undoKey)
 }
 
-func (utxo *UTXOSet) DeleteByPrefix(prefix []byte) {
+// Adds the spent output back to the outputs of its transaction, in its original position
+func restoreOutput(outs TxOutputs, spent SpentOutput) TxOutputs {
+	restored := TxOutputs{}
+	added := false
+	for j, out := range outs.Outputs {
+		if !added && outs.Index(j) > spent.Index {
+			restored.Outputs = append(restored.Outputs, spent.Output)
+			restored.Indexes = append(restored.Indexes, spent.Index)
+			added = true
+		}
+		restored.Outputs = append(restored.Outputs, out)
+		restored.Indexes = append(restored.Indexes, outs.Index(j))
+	}
+	if !added {
+		restored.Outputs = append(restored.Outputs, spent.Output)
+		restored.Indexes = append(restored.Indexes, spent.Index)
+	}
+
+	return restored
+}
+
+// Reverts the block on an in-memory UTXO set with its undo data, the same way Undo does on the database
+func undoTransactions(set map[string]TxOutputs, block *Block, undo BlockUndo) {
+	createdTxs := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		createdTxs[hex.EncodeToString(tx.ID)] = true
+		delete(set, hex.EncodeToString(tx.ID))
+	}
+
+	for i := len(undo.Spent) - 1; i >= 0; i-- {
+		spent := undo.Spent[i]
+		txID := hex.EncodeToString(spent.TxID)
+		if createdTxs[txID] {
+			continue
+		}
+		set[txID] = restoreOutput(set[txID], spent)
+	}
+}
+
+// The undo data of a block of the active chain, which must not be pruned
+func (chain *Blockchain) blockUndo(block *Block) (BlockUndo, error) {
+	if block.IsPruned() {
+		return BlockUndo{}, fmt.Errorf("Block %d is pruned, its changes to the UTXO set can't be reverted: %w", block.Height, ErrBlockPruned)
+	}
+	data, err := chain.Database.Get(append(undoPrefix, block.Hash...))
+	if err == storage.ErrNotFound {
+		return BlockUndo{}, fmt.Errorf("Block %d: %w", block.Height, ErrUndoNotAvailable)
+	} else if err != nil {
+		return BlockUndo{}, err
+	}
+
+	return DeserializeUndo(data)
+}
+
+/*
+	Reverts the blocks of the active chain on an in-memory copy of its whole UTXO set with their undo
+	data, from the tip down until stop returns true. Returns the block it stopped at, the set is the
+	one after that block. The caller must hold the lock
+*/
+func (chain *Blockchain) revertSet(set map[string]TxOutputs, stop func(*Block) bool) (*Block, error) {
+	iter := &BlockchainIterator{chain.lastHash, chain.Database}
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if stop(block) {
+			return block, nil
+		}
+
+		undo, err := chain.blockUndo(block)
+		if err != nil {
+			return nil, err
+		}
+		undoTransactions(set, block, undo)
+	}
+}
+
+// Same as revertSet on a state, down to the block with the hash
+func (chain *Blockchain) revertState(state *utxoState, hash []byte) (*Block, error) {
+	iter := &BlockchainIterator{chain.lastHash, chain.Database}
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(block.Hash, hash) {
+			return block, nil
+		}
+
+		undo, err := chain.blockUndo(block)
+		if err != nil {
+			return nil, err
+		}
+		if err := state.disconnect(block, undo); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Returns the output index of the transaction if it is still in the UTXO set
+func (u UTXOSet) FindOutput(txID []byte, index int) (TxOutput, error) {
+	v, err := u.Blockchain.Database.Get(append(utxoPrefix, txID...))
+	if err == storage.ErrNotFound {
+		return TxOutput{}, fmt.Errorf("Output %x:%d: %w", txID, index, ErrNotFound)
+	} else if err != nil {
+		return TxOutput{}, err
+	}
+	outs, err := DeserializeOutputs(v)
+	if err != nil {
+		return TxOutput{}, err
+	}
+
+	for i, out := range outs.Outputs {
+		if outs.Index(i) == index {
+			return out, nil
+		}
+	}
+
+	return TxOutput{}, fmt.Errorf("Output %x:%d: %w", txID, index, ErrNotFound)
+}
+
+/*
+	Builds a transaction with the unspent outputs of the UTXO set placed in their original positions,
+	it is enough to verify the inputs spending them when the block of the transaction was pruned
+*/
+func (u UTXOSet) FindTransaction(ID []byte) (Transaction, error) {
+	v, err := u.Blockchain.Database.Get(append(utxoPrefix, ID...))
+	if err == storage.ErrNotFound {
+		return Transaction{}, fmt.Errorf("Transaction %x: %w", ID, ErrNotFound)
+	} else if err != nil {
+		return Transaction{}, err
+	}
+	outs, err := DeserializeOutputs(v)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	tx := Transaction{ID: ID}
+	for i, out := range outs.Outputs {
+		for len(tx.Outputs) <= outs.Index(i) {
+			tx.Outputs = append(tx.Outputs, TxOutput{})
+		}
+		tx.Outputs[outs.Index(i)] = out
+	}
+
+	return tx, nil
+}
+
+func (utxo *UTXOSet) DeleteByPrefix(prefix []byte) error {
 	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := utxo.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return utxo.Blockchain.Database.Update(func(batch storage.Batch) error {
 			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
+				if err := batch.Delete(key); err != nil {
 					return err
 				}
 			}
 			return nil
-		}); err != nil {
-			return err
-		}
-		return nil
+		})
 	}
 
 	collectSize := 100000
-	utxo.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
-		}
-		if keysCollected > 0 {
+	keysForDelete := make([][]byte, 0, collectSize)
+
+	err := utxo.Blockchain.Database.Iterate(prefix, func(key, value []byte) error {
+		keysForDelete = append(keysForDelete, key)
+		if len(keysForDelete) == collectSize {
 			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+				return err
 			}
+			keysForDelete = make([][]byte, 0, collectSize)
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if len(keysForDelete) > 0 {
+		return deleteKeys(keysForDelete)
+	}
+
+	return nil
 }
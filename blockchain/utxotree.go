@@ -0,0 +1,236 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+/*
+	The UTXO commitment is the root of a sparse merkle tree with a leaf for every unspent output.
+	The path of a leaf is the hash of its outpoint, the transaction ID and the output index, so the
+	tree only depends on the outputs in the set and never on the order they were added. A subtree
+	with a single leaf is that leaf, so the tree is only as deep as needed to tell its leaves apart.
+	Leaves and inner nodes are hashed with different prefixes, so one can never pass for the other.
+
+	Adding or removing an output only hashes again the nodes on its path. Nodes are never changed,
+	a new tree shares all the other nodes with the old one, so a block can be applied to the tree
+	of the tip without touching it until the block is connected
+*/
+
+const (
+	utxoLeafPrefix = 0x00
+	utxoNodePrefix = 0x01
+)
+
+var emptyUTXOHash = make([]byte, sha256.Size) // Hash of a subtree without leaves
+
+type utxoNode struct {
+	left  *utxoNode
+	right *utxoNode
+	key   []byte // Path of a leaf, nil for inner nodes
+	hash  []byte
+}
+
+func outpointKey(txID []byte, index int) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(index))
+	hash := sha256.Sum256(append(append([]byte{}, txID...), buf[:]...))
+
+	return hash[:]
+}
+
+func utxoLeafHash(key []byte, index int, out TxOutput) []byte {
+	data := append(append([]byte{utxoLeafPrefix}, key...), encodeUTXO(index, out)...)
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+func utxoNodeHash(left, right []byte) []byte {
+	data := append(append([]byte{utxoNodePrefix}, left...), right...)
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+func newUTXOLeaf(txID []byte, index int, out TxOutput) *utxoNode {
+	key := outpointKey(txID, index)
+
+	return &utxoNode{key: key, hash: utxoLeafHash(key, index, out)}
+}
+
+// Joins two subtrees, a single leaf moves up in place of the node so the tree stays the same for the same set
+func newUTXOInner(left, right *utxoNode) *utxoNode {
+	if left == nil && right == nil {
+		return nil
+	}
+	if left == nil && right.key != nil {
+		return right
+	}
+	if right == nil && left.key != nil {
+		return left
+	}
+
+	return &utxoNode{left: left, right: right, hash: utxoNodeHash(left.subtreeHash(), right.subtreeHash())}
+}
+
+func (n *utxoNode) subtreeHash() []byte {
+	if n == nil {
+		return emptyUTXOHash
+	}
+
+	return n.hash
+}
+
+// The commitment of the tree, nil for an empty set
+func (n *utxoNode) root() []byte {
+	if n == nil {
+		return nil
+	}
+
+	return n.hash
+}
+
+// Bit of the key choosing the child at the depth, 0 goes left
+func keyBit(key []byte, depth int) int {
+	return int(key[depth/8]>>(7-depth%8)) & 1
+}
+
+// Returns a tree with the leaf added, or replacing the leaf with the same key
+func (n *utxoNode) insert(leaf *utxoNode, depth int) *utxoNode {
+	if n == nil {
+		return leaf
+	}
+
+	left, right := n.left, n.right
+	if n.key != nil {
+		if bytes.Equal(n.key, leaf.key) {
+			return leaf
+		}
+		// Both leaves go one level down, or more when their keys start the same
+		left, right = nil, nil
+		if keyBit(n.key, depth) == 0 {
+			left = n
+		} else {
+			right = n
+		}
+	}
+
+	if keyBit(leaf.key, depth) == 0 {
+		left = left.insert(leaf, depth+1)
+	} else {
+		right = right.insert(leaf, depth+1)
+	}
+
+	return newUTXOInner(left, right)
+}
+
+// Returns a tree without the leaf with the key, the same tree when it is not in it
+func (n *utxoNode) remove(key []byte, depth int) *utxoNode {
+	if n == nil {
+		return nil
+	}
+	if n.key != nil {
+		if bytes.Equal(n.key, key) {
+			return nil
+		}
+		return n
+	}
+
+	if keyBit(key, depth) == 0 {
+		return newUTXOInner(n.left.remove(key, depth+1), n.right)
+	}
+
+	return newUTXOInner(n.left, n.right.remove(key, depth+1))
+}
+
+// The hashes of the siblings on the path to the leaf with the key from the root down, false when it is not in the tree
+func (n *utxoNode) path(key []byte) ([][]byte, bool) {
+	var siblings [][]byte
+
+	for depth := 0; n != nil && n.key == nil; depth++ {
+		if keyBit(key, depth) == 0 {
+			siblings = append(siblings, n.right.subtreeHash())
+			n = n.left
+		} else {
+			siblings = append(siblings, n.left.subtreeHash())
+			n = n.right
+		}
+	}
+
+	if n == nil || !bytes.Equal(n.key, key) {
+		return nil, false
+	}
+
+	return siblings, true
+}
+
+// Rebuilds the root from an output and the siblings on its path
+func verifyUTXOPath(txID []byte, index int, out TxOutput, siblings [][]byte, root []byte) bool {
+	key := outpointKey(txID, index)
+	if len(siblings) > len(key)*8 {
+		return false
+	}
+
+	hash := utxoLeafHash(key, index, out)
+	for depth := len(siblings) - 1; depth >= 0; depth-- {
+		if keyBit(key, depth) == 0 {
+			hash = utxoNodeHash(hash, siblings[depth])
+		} else {
+			hash = utxoNodeHash(siblings[depth], hash)
+		}
+	}
+
+	return bytes.Equal(hash, root)
+}
+
+func buildUTXOTree(entries []UTXOEntry) *utxoNode {
+	var tree *utxoNode
+
+	for _, entry := range entries {
+		for i, out := range entry.Outputs.Outputs {
+			tree = tree.insert(newUTXOLeaf(entry.TxID, entry.Outputs.Index(i), out), 0)
+		}
+	}
+
+	return tree
+}
+
+// The tree of the UTXO set at a tip, kept so the blocks built on that tip don't rebuild it
+type treeCache struct {
+	mutex sync.Mutex
+	tip   []byte
+	tree  *utxoNode
+}
+
+/*
+	Returns the tree of the UTXO set at the tip, it is only built from the whole set the first time
+	or after the set changed without the cache knowing. The caller must hold the lock of the chain
+*/
+func (chain *Blockchain) tipTree() (*utxoNode, error) {
+	cache := &chain.trees
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.tip != nil && bytes.Equal(cache.tip, chain.lastHash) {
+		return cache.tree, nil
+	}
+
+	entries, err := UTXOSet{chain}.Entries()
+	if err != nil {
+		return nil, err
+	}
+	cache.tip, cache.tree = chain.lastHash, buildUTXOTree(entries)
+
+	return cache.tree, nil
+}
+
+// Keeps the tree of the UTXO set after the block at tip, a nil tip forgets it
+func (chain *Blockchain) cacheTree(tip []byte, tree *utxoNode) {
+	chain.trees.mutex.Lock()
+	defer chain.trees.mutex.Unlock()
+
+	chain.trees.tip, chain.trees.tree = tip, tree
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+func testEntries(count int) []UTXOEntry {
+	var entries []UTXOEntry
+	for i := 0; i < count; i++ {
+		txID := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		outs := TxOutputs{}
+		for j := 0; j <= i%3; j++ {
+			outs.Outputs = append(outs.Outputs, TxOutput{Value: i*10 + j, PubKeyHash: txID[:20]})
+			outs.Indexes = append(outs.Indexes, j*2)
+		}
+		entries = append(entries, UTXOEntry{txID[:], outs})
+	}
+
+	return entries
+}
+
+// The tree updated one output at a time must be the tree built from the set it ends with, whatever the order
+func TestUTXOTreeIncremental(t *testing.T) {
+	entries := testEntries(50)
+	random := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		name   string
+		remove int // Entries removed again after all of them were added
+	}{
+		{"add all", 0},
+		{"remove some", 20},
+		{"remove all but one", 49},
+		{"remove all", 50},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tree *utxoNode
+			for _, i := range random.Perm(len(entries)) {
+				for j, out := range entries[i].Outputs.Outputs {
+					tree = tree.insert(newUTXOLeaf(entries[i].TxID, entries[i].Outputs.Index(j), out), 0)
+				}
+			}
+			order := random.Perm(len(entries))
+			for _, i := range order[:test.remove] {
+				for j := range entries[i].Outputs.Outputs {
+					tree = tree.remove(outpointKey(entries[i].TxID, entries[i].Outputs.Index(j)), 0)
+				}
+			}
+
+			var left []UTXOEntry
+			for _, i := range order[test.remove:] {
+				left = append(left, entries[i])
+			}
+			expected := UTXOCommitment(left)
+			if !bytes.Equal(tree.root(), expected) {
+				t.Fatalf("Root %x, rebuilt %x", tree.root(), expected)
+			}
+			if len(left) == 0 && tree != nil {
+				t.Fatal("The tree of an empty set has nodes")
+			}
+		})
+	}
+}
+
+func TestUTXOTreePath(t *testing.T) {
+	entries := testEntries(20)
+	tree := buildUTXOTree(entries)
+	entry := entries[7]
+	out := entry.Outputs.Outputs[1]
+	index := entry.Outputs.Index(1)
+
+	siblings, ok := tree.path(outpointKey(entry.TxID, index))
+	if !ok {
+		t.Fatal("No path to an output of the set")
+	}
+
+	tampered := out
+	tampered.Value++
+	tests := []struct {
+		name     string
+		index    int
+		out      TxOutput
+		siblings [][]byte
+		root     []byte
+		valid    bool
+	}{
+		{"valid", index, out, siblings, tree.root(), true},
+		{"other value", index, tampered, siblings, tree.root(), false},
+		{"other index", index + 1, out, siblings, tree.root(), false},
+		{"missing sibling", index, out, siblings[1:], tree.root(), false},
+		{"other root", index, out, siblings, emptyUTXOHash, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := verifyUTXOPath(entry.TxID, test.index, test.out, test.siblings, test.root); valid != test.valid {
+				t.Fatalf("Path valid %t, expected %t", valid, test.valid)
+			}
+		})
+	}
+
+	if _, ok := tree.path(outpointKey(entry.TxID, 99)); ok {
+		t.Fatal("Path to an output not in the set")
+	}
+}
+
+// An inner node can't be passed off as a leaf, so a path can't stop half way down the tree
+func TestUTXOTreeDomainSeparation(t *testing.T) {
+	left, right := make([]byte, sha256.Size), make([]byte, sha256.Size)
+	right[0] = 1
+
+	node := utxoNodeHash(left, right)
+	plain := sha256.Sum256(append(append([]byte{}, left...), right...))
+	if bytes.Equal(node, plain[:]) {
+		t.Fatal("Inner nodes are hashed without a prefix")
+	}
+
+	key := outpointKey(left, 0)
+	out := TxOutput{Value: 1, PubKeyHash: right[:20]}
+	leaf := utxoLeafHash(key, 0, out)
+	data := append(append([]byte{}, key...), encodeUTXO(0, out)...)
+	if bytes.Equal(leaf, utxoNodeHash(data[:sha256.Size], data[sha256.Size:])) {
+		t.Fatal("A leaf hashes like an inner node")
+	}
+}
@@ -0,0 +1,259 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Below this number of inputs it is faster to verify them one after the other
+const parallelVerifyThreshold = 16
+
+type inputCheck struct {
+	tx      *Transaction
+	inIdx   int
+	prevTxs map[string]Transaction
+}
+
+/*
+	Verifies the signatures of the inputs. Big batches, like the inputs of a whole block, are
+	fanned out across a pool with one worker per CPU and the first invalid input stops the rest
+*/
+func verifyInputs(checks []inputCheck, cache *SigCache, store bool) bool {
+	workers := runtime.NumCPU()
+
+	if len(checks) < parallelVerifyThreshold || workers < 2 {
+		for _, check := range checks {
+			if !check.tx.VerifyInput(check.inIdx, check.prevTxs, cache, store) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var failed int32
+	var wg sync.WaitGroup
+	jobs := make(chan inputCheck)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range jobs {
+				if atomic.LoadInt32(&failed) == 1 {
+					continue
+				}
+				if !check.tx.VerifyInput(check.inIdx, check.prevTxs, cache, store) {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	for _, check := range checks {
+		if atomic.LoadInt32(&failed) == 1 {
+			break
+		}
+		jobs <- check
+	}
+	close(jobs)
+	wg.Wait()
+
+	return failed == 0
+}
+
+func inputChecks(tx *Transaction, prevTxs map[string]Transaction) []inputCheck {
+	var checks []inputCheck
+	for inIdx := range tx.Inputs {
+		checks = append(checks, inputCheck{tx, inIdx, prevTxs})
+	}
+
+	return checks
+}
+
+// The coins of an output no key can unlock would be burned, so data-carrier outputs can't have any
+func checkDataCarriers(tx *Transaction) bool {
+	for _, out := range tx.Outputs {
+		if out.IsDataCarrier() && (out.Value != 0 || len(out.Data) > MaxDataCarrierSize) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Values are signed, so an output with a negative value would pay for more than its inputs or a
+	coinbase bigger than the subsidy without changing the totals. Only data-carrier outputs can be
+	empty, every other output must pay something
+*/
+func checkOutputValues(tx *Transaction) bool {
+	for _, out := range tx.Outputs {
+		if out.Value < 0 || (out.Value == 0 && !out.IsDataCarrier()) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Verifies all the transactions going into a block. The signatures that were already verified
+	when the transactions entered the memory pool are taken from the signature cache. A transaction
+	can spend the outputs of the ones before it in the block, except the coinbase, and no
+	transaction can spend more than its inputs. The coinbase can take the subsidy and the fees
+*/
+func (chain *Blockchain) VerifyBlockTransactions(transactions []*Transaction) bool {
+	return chain.checkBlockTransactions(transactions) == nil
+}
+
+// Same as VerifyBlockTransactions, the error wraps ErrInvalidTransaction and tells what is wrong
+func (chain *Blockchain) checkBlockTransactions(transactions []*Transaction) error {
+	var checks []inputCheck
+	earlier := make(map[string]*Transaction)
+	fees, minted := 0, 0
+
+	for _, tx := range transactions {
+		if !checkDataCarriers(tx) {
+			return fmt.Errorf("%w: transaction %x has an invalid data-carrier output", ErrInvalidTransaction, tx.ID)
+		}
+		if !checkOutputValues(tx) {
+			return fmt.Errorf("%w: transaction %x has an output with no value", ErrInvalidTransaction, tx.ID)
+		}
+		if tx.IsCoinbase() {
+			minted += tx.OutputValue()
+			continue
+		}
+
+		prevTxs, err := chain.previousTransactions(tx, earlier)
+		if err != nil || !tx.checkIfInputsExists(prevTxs) {
+			return fmt.Errorf("%w: transaction %x spends outputs that don't exist", ErrInvalidTransaction, tx.ID)
+		}
+		fee, err := tx.Fee(prevTxs)
+		if err != nil || fee < 0 {
+			return fmt.Errorf("%w: transaction %x spends more than its inputs", ErrInvalidTransaction, tx.ID)
+		}
+		fees += fee
+
+		checks = append(checks, inputChecks(tx, prevTxs)...)
+		earlier[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	if minted > Subsidy+fees {
+		return fmt.Errorf("%w: coinbase creates %d, more than the subsidy and the fees %d", ErrInvalidTransaction, minted, Subsidy+fees)
+	}
+
+	if !verifyInputs(checks, chain.SigCache, false) {
+		return fmt.Errorf("%w: invalid signature", ErrInvalidTransaction)
+	}
+
+	return nil
+}
+
+/*
+	Validates a full block against the UTXO set left by its parent and applies the block to it in
+	memory: the link and height, the proof of work and merkle root, the transactions and their
+	signatures and the UTXO commitment. The error wraps ErrInvalidBlock and tells what is wrong
+*/
+func (chain *Blockchain) checkBlockOnState(state *utxoState, parent, block *Block) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w %x: %s", ErrInvalidBlock, block.Hash, reason)
+	}
+
+	if !bytes.Equal(block.PrevHash, parent.Hash) {
+		return invalid("doesn't link to the previous block")
+	}
+	if block.Height != parent.Height+1 {
+		return invalid(fmt.Sprintf("has height %d after block %d", block.Height, parent.Height))
+	}
+	if block.IsPruned() {
+		return invalid("has no transactions")
+	}
+	if reason := checkBlockData(block); reason != "" {
+		return invalid(reason)
+	}
+	if len(parent.UTXORoot) != 0 && len(block.UTXORoot) == 0 {
+		return invalid("has no UTXO commitment after a block with one")
+	}
+
+	reason, _, err := replayBlock(state, block, chain.SigCache, true)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return invalid(reason)
+	}
+
+	return nil
+}
+
+/*
+	Validates a block extending the tip against the UTXO set of the chain, only the entries the block
+	touches are read. Returns the tree of the UTXO set after the block. The caller must hold the lock
+*/
+func (chain *Blockchain) checkTip(block *Block) (*utxoNode, error) {
+	tip, err := chain.GetBlock(chain.lastHash)
+	if err != nil && err != ErrBlockPruned {
+		return nil, err
+	}
+	tree, err := chain.tipTree()
+	if err != nil {
+		return nil, err
+	}
+
+	state := newUTXOState(chain.Database, tree)
+	if err := chain.checkBlockOnState(state, &tip, block); err != nil {
+		return nil, err
+	}
+
+	return state.tree, nil
+}
+
+/*
+	Validates the branch ending in the block before the chain switches to it. The blocks of the active
+	chain above the fork are reverted in memory with their undo data and every block of the branch is
+	replayed on the set left, so nothing is written when one of them is invalid or when the active
+	chain can't be reverted to the fork, as when its blocks are pruned. Returns the blocks of the
+	branch after the fork, the new block last, and the tree of the UTXO set after it. The caller must
+	hold the write lock
+*/
+func (chain *Blockchain) checkBranch(block *Block) ([]*Block, *utxoNode, error) {
+	hashes, err := chain.chainHashes()
+	if err != nil {
+		return nil, nil, err
+	}
+	active := make(map[string]bool)
+	for _, hash := range hashes {
+		active[hex.EncodeToString(hash)] = true
+	}
+
+	branch := []*Block{block}
+	for !active[hex.EncodeToString(branch[0].PrevHash)] {
+		prev, err := chain.GetBlock(branch[0].PrevHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		branch = append([]*Block{&prev}, branch...)
+	}
+
+	tree, err := chain.tipTree()
+	if err != nil {
+		return nil, nil, err
+	}
+	state := newUTXOState(chain.Database, tree)
+	fork, err := chain.revertState(state, branch[0].PrevHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parent := fork
+	for _, b := range branch {
+		if err := chain.checkBlockOnState(state, parent, b); err != nil {
+			return nil, nil, err
+		}
+		parent = b
+	}
+
+	return branch, state.tree, nil
+}
@@ -1,14 +1,26 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/blockchain-app-go/blockchain"
+	"github.com/blockchain-app-go/datadir"
+	"github.com/blockchain-app-go/mempool"
+	"github.com/blockchain-app-go/mining"
 	"github.com/blockchain-app-go/network"
 	"github.com/blockchain-app-go/wallet"
 )
@@ -16,19 +28,52 @@ import (
 type CommandLine struct{}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] COMMAND")
+	fmt.Println(" -datadir DIR - Root directory of the data of the nodes, DATA_DIR env. var. or ./tmp by default")
 	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
-	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
+	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address, -regtest creates the regtest chain instead")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
-	fmt.Println(" createwallet - Creates a new Wallet")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -blocks N -sighash TYPE -rbf -mine - Send amount of coins. Then -mine flag is set, mine off of this node, -rbf lets bumpfee replace it. Without -fee the fee is estimated to confirm within N blocks")
+	fmt.Println(" estimatefee -blocks N - Prints the fee rate likely to get a transaction mined within N blocks")
+	fmt.Println(" bumpfee -txid ID -fee FEE - Replaces an unconfirmed transaction sent with -rbf by one paying FEE")
+	fmt.Println(" createwallet -type TYPE - Creates a new Wallet, TYPE is p256 (default) or ed25519")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" verifychain -depth N - Audits the whole chain and the UTXO set, signatures are only checked in the last N blocks (default all)")
+	fmt.Println(" exportchain -out FILE -from H -to H - Writes the blocks from height H to H (default the whole chain) to a bootstrap file")
+	fmt.Println(" importchain -in FILE - Validates and adds the blocks of a bootstrap file, an interrupted import can be run again")
+	fmt.Println(" dumputxo -out FILE -height H - Writes a snapshot of the UTXO set at the height, the tip by default")
+	fmt.Println(" loadutxo -in FILE - Bootstraps a new node from a snapshot pinned in the chain parameters")
+	fmt.Println(" startnode -miner ADDRESS -regtest -datacarriersize SIZE -prune N -blockmaxsize SIZE -trigger count|interval|continuous|none -mintxs N -interval DURATION -workaddr ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining, -prune keeps only the last N blocks, -regtest runs on the regtest chain in memory")
+	fmt.Println(" timestamp -file PATH -from FROM -mine - Embeds the hash of the file in the blockchain")
+	fmt.Println(" verifytimestamp -file PATH -txid ID - Prints when the hash of the file was embedded in the blockchain")
+	fmt.Println(" getutxoproof -txid ID -out FILE - Writes the proof that the outputs of the transaction are unspent")
+	fmt.Println(" verifyutxoproof -in FILE - Checks a proof written by getutxoproof without the blockchain")
+	fmt.Println(" savemempool - Asks the running node to save its memory pool to disk")
+	fmt.Println(" getmempoolinfo - Prints a summary of the memory pool saved by the node")
+	fmt.Println(" getblocktemplate -miner ADDRESS -maxsize SIZE - Prints the block the running node would mine with its memory pool")
+	fmt.Println(" pausemining - Asks the running node to stop mining new blocks")
+	fmt.Println(" resumemining - Asks the running node to mine again")
+	fmt.Println(" miner -node ADDRESS -batch N - Mines blocks for the node serving work on ADDRESS, asking for new work every N nonces")
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+// Library errors are returned up to the CLI, which is the only layer that ends the program
+func handleError(err error) {
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+}
+
+func openChain(nodeID string) *blockchain.Blockchain {
+	chain, err := blockchain.ContinueBlockchain(nodeID)
+	handleError(err)
+
+	return chain
+}
+
+func (cli *CommandLine) validateArgs(args []string) {
+	if len(args) < 1 {
 		cli.printUsage()
 		runtime.Goexit()
 	}
@@ -40,20 +85,22 @@ func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
 	if len(minerAddress) > 0 {
 		if wallet.ValidateAddress(minerAddress) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+			fmt.Printf("Mining policy: %s\n", network.MiningPolicy)
 		} else {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeID, minerAddress)
+	handleError(network.StartServer(nodeID, minerAddress))
 }
 
 func (cli *CommandLine) reindexUTXO(nodeID string) {
-	chain := blockchain.ContinueBlockchain(nodeID)
+	chain := openChain(nodeID)
 	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	handleError(UTXOSet.Reindex())
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	handleError(err)
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
@@ -67,26 +114,60 @@ func (cli *CommandLine) listAddresses(nodeID string) {
 
 }
 
-func (cli *CommandLine) createWallet(nodeID string) {
+func (cli *CommandLine) createWallet(keyType, nodeID string) {
+	kind, err := wallet.ParseKeyType(keyType)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	wallets, _ := wallet.CreateWallets(nodeID)
-	address := wallets.AddWallet()
-	wallets.SaveFile(nodeID)
+	address, err := wallets.AddWallet(kind)
+	handleError(err)
+	handleError(wallets.SaveFile(nodeID))
 
 	fmt.Printf("New address is: %s\n", address)
 }
 
+// An inconsistent chain ends the program with a non-zero exit code so it can be used in scripts
+func (cli *CommandLine) verifyChain(depth int, nodeID string) {
+	chain := openChain(nodeID)
+	report, err := chain.VerifyChain(depth)
+	chain.Database.Close()
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Checked %d blocks up to height %d, %d with transactions\n", report.Blocks, report.Height, report.FullBlocks)
+	fmt.Printf("Verified %d signatures\n", report.Signatures)
+	if report.UTXOChecked {
+		fmt.Println("UTXO set matches the chain")
+	} else {
+		fmt.Println("UTXO set not checked, the chain is pruned")
+	}
+	fmt.Println("Done! The chain is consistent")
+}
+
 func (cli *CommandLine) printChain(nodeID string) {
-	chain := blockchain.ContinueBlockchain(nodeID)
+	chain := openChain(nodeID)
 	defer chain.Database.Close()
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		handleError(err)
 
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
 		pow := blockchain.NewProof(block)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+		if len(block.UTXORoot) > 0 {
+			fmt.Printf("UTXO root: %x\n", block.UTXORoot)
+		}
+		if block.IsPruned() {
+			fmt.Println("Transactions pruned")
+		}
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
 		}
@@ -102,27 +183,36 @@ func (cli *CommandLine) createBlockChain(address, nodeID string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
-	chain := blockchain.InitBlockchain(address, nodeID)
+	chain, err := blockchain.InitBlockchain(address, nodeID)
+	handleError(err)
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
-
 	fmt.Println("Finished!")
 }
 
+func (cli *CommandLine) createRegtestChain(nodeID string) {
+	genesis, err := blockchain.RegtestGenesis()
+	handleError(err)
+	chain, err := blockchain.InitBlockchainFromGenesis(genesis, nodeID)
+	handleError(err)
+	defer chain.Database.Close()
+
+	fmt.Printf("Finished! Regtest chain with genesis %x\n", genesis.Hash)
+}
+
 func (cli *CommandLine) getBalance(address, nodeID string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
-	chain := blockchain.ContinueBlockchain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
+	chain := openChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
 	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	_, pubKeyHash, err := wallet.DecodeAddress(address)
+	handleError(err)
+	UTXOs, err := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	handleError(err)
 
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -131,45 +221,556 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 	fmt.Printf("Balance of %s: %d\n", address, balance)
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CommandLine) send(from, to string, amount, fee, blocks int, sigHash, nodeID string, replaceable, mineNow bool) {
+	hashType, err := blockchain.ParseSigHashType(sigHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	if !wallet.ValidateAddress(to) {
 		log.Panic("Address is not Valid")
 	}
 	if !wallet.ValidateAddress(from) {
 		log.Panic("Address is not Valid")
 	}
-	chain := blockchain.ContinueBlockchain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
+	chain := openChain(nodeID)
 	defer chain.Database.Close()
+	pool := openMempool(chain, nodeID)
 
 	wallets, err := wallet.CreateWallets(nodeID)
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
+	wallet, err := wallets.GetWallet(from)
+	handleError(err)
+
+	build := func(fee int) (*blockchain.Transaction, error) {
+		if replaceable {
+			return blockchain.NewReplaceableTransaction(&wallet, to, amount, fee, pool)
+		}
+		return blockchain.NewTransaction(&wallet, to, amount, fee, pool)
+	}
+
+	// A bigger fee can take more inputs, so the fee is raised until it pays for the size of the transaction
+	var tx *blockchain.Transaction
+	if fee < 0 {
+		rate, ok := estimatedFeeRate(blocks, nodeID)
+		fee = 0
+		tx, err = build(fee)
+		for ok && err == nil && fee < feeForSize(rate, tx) {
+			fee = feeForSize(rate, tx)
+			tx, err = build(fee)
+		}
+	} else {
+		tx, err = build(fee)
+	}
+	handleError(err)
+	if hashType != blockchain.SigHashAll {
+		prevTxs, err := pool.GetPreviousTransactions(tx)
+		handleError(err)
+		handleError(tx.SignWithHashType(&wallet, prevTxs, hashType))
+	}
+	cli.submit(chain, pool, tx, from, nodeID, mineNow)
+
+	fmt.Printf("Transaction %x paying a fee of %d\n", tx.ID, fee)
+	fmt.Println("Success!")
+}
+
+// The fee rate estimated by the node from the blocks it saw, false when it has no estimate yet
+func estimatedFeeRate(blocks int, nodeID string) (float64, bool) {
+	estimator, err := mempool.ReadFeeEstimator(datadir.FeeEstimatesFile(nodeID))
+	if os.IsNotExist(err) {
+		fmt.Println("The node has no fee estimates yet, sending without a fee")
+		return 0, false
+	}
+	handleError(err)
+
+	rate, err := estimator.EstimateFee(blocks)
+	if errors.Is(err, mempool.ErrNoEstimate) {
+		fmt.Println("The node has no fee estimates yet, sending without a fee")
+		return 0, false
+	}
+	handleError(err)
+
+	return rate, true
+}
+
+func feeForSize(rate float64, tx *blockchain.Transaction) int {
+	return int(math.Ceil(rate * float64(len(tx.Serialize()))))
+}
+
+func (cli *CommandLine) estimateFee(blocks int, nodeID string) {
+	estimator, err := mempool.ReadFeeEstimator(datadir.FeeEstimatesFile(nodeID))
+	if os.IsNotExist(err) {
+		fmt.Printf("Node %s has not saved fee estimates yet\n", nodeID)
+		return
+	}
+	handleError(err)
+
+	rate, err := estimator.EstimateFee(blocks)
+	handleError(err)
+
+	fmt.Printf("Fee rate to be mined within %d blocks: %.6f per byte, %.3f per 1000 bytes\n", blocks, rate, rate*1000)
+}
+
+// The replacement takes the extra fee from the change of the transaction and is sent to the network
+func (cli *CommandLine) bumpFee(txID string, fee int, nodeID string) {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := openChain(nodeID)
+	defer chain.Database.Close()
+	pool := openMempool(chain, nodeID)
+
+	tx, ok := pool.Get(ID)
+	if !ok {
+		fmt.Printf("Transaction %s is not in the memory pool of node %s\n", txID, nodeID)
+		return
+	}
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	var owner *wallet.Wallet
+	for _, address := range wallets.GetAllAddresses() {
+		if bytes.Equal(wallets.Wallets[address].PublicKey, tx.Inputs[0].PubKey) {
+			owner = wallets.Wallets[address]
+		}
+	}
+	if owner == nil {
+		fmt.Printf("Transaction %s was not sent by a wallet of node %s\n", txID, nodeID)
+		return
+	}
+
+	replacement, err := blockchain.BumpFee(owner, tx, fee, pool)
+	handleError(err)
+	cli.submit(chain, pool, replacement, "", nodeID, false)
+
+	fmt.Printf("Transaction %s replaced by %x paying a fee of %d\n", txID, replacement.ID, fee)
+}
+
+/*
+	The wallet builds its transactions on top of the memory pool saved by the node, so it can spend
+	the change of the transactions it sent before they are mined
+*/
+func openMempool(chain *blockchain.Blockchain, nodeID string) *mempool.Mempool {
+	pool := mempool.New(chain, network.MempoolPolicy)
+	_, _, err := pool.Load(datadir.MempoolFile(nodeID))
+	handleError(err)
+
+	return pool
+}
+
+// Mines the transaction right away with the unconfirmed transactions it spends, or sends it to the network
+func (cli *CommandLine) submit(chain *blockchain.Blockchain, pool *mempool.Mempool, tx *blockchain.Transaction, minerAddress, nodeID string, mineNow bool) {
+	handleError(pool.Add(tx))
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
 	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		var txs []*blockchain.Transaction
+		fees := 0
+		for _, desc := range pool.Package(tx.ID) {
+			txs = append(txs, desc.Tx)
+			fees += desc.Fee
+		}
+		cbTx, err := blockchain.CoinbaseTxWithFees(minerAddress, "", fees)
+		handleError(err)
+		txs = append([]*blockchain.Transaction{cbTx}, txs...)
+		block, err := chain.MineBlock(txs)
+		handleError(err)
+		pool.RemoveBlock(block)
 	} else {
 		network.SendTx(network.KnownNodes[0], tx)
 		fmt.Println("send tx")
 	}
 
-	fmt.Println("Success!")
+	handleError(pool.Save(datadir.MempoolFile(nodeID)))
+}
+
+func (cli *CommandLine) timestamp(path, from, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("Address is not Valid")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	fileHash := sha256.Sum256(content)
+
+	chain := openChain(nodeID)
+	defer chain.Database.Close()
+	pool := openMempool(chain, nodeID)
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, err := wallets.GetWallet(from)
+	handleError(err)
+
+	tx, err := blockchain.NewDataTransaction(&wallet, fileHash[:], pool)
+	handleError(err)
+	cli.submit(chain, pool, tx, from, nodeID, mineNow)
+
+	fmt.Printf("File hash %x embedded in transaction %x\n", fileHash, tx.ID)
+}
+
+func (cli *CommandLine) verifyTimestamp(path, txID, nodeID string) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	fileHash := sha256.Sum256(content)
+
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := openChain(nodeID)
+	defer chain.Database.Close()
+
+	block, err := chain.FindTransactionBlock(ID)
+	handleError(err)
+
+	var tx *blockchain.Transaction
+	for _, blockTx := range block.Transactions {
+		if bytes.Equal(blockTx.ID, ID) {
+			tx = blockTx
+		}
+	}
+
+	found := false
+	for _, data := range tx.Data() {
+		if bytes.Equal(data, fileHash[:]) {
+			found = true
+		}
+	}
+	if !found {
+		fmt.Printf("File hash %x is not embedded in transaction %x\n", fileHash, ID)
+		runtime.Goexit()
+	}
+
+	proof, err := block.TransactionProof(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+	root := block.HashTransaction()
+
+	fmt.Printf("File hash: %x\n", fileHash)
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Time: %s\n", time.Unix(block.Timestamp, 0).UTC().Format(time.RFC3339))
+	fmt.Printf("Merkle root: %x\n", root)
+	fmt.Println("Merkle proof:")
+	for _, node := range proof {
+		if node.Left {
+			fmt.Printf("  left:  %x\n", node.Hash)
+		} else {
+			fmt.Printf("  right: %x\n", node.Hash)
+		}
+	}
+	valid := blockchain.VerifyMerkleProof(tx.Serialize(), proof, root)
+	fmt.Printf("Proof valid: %s\n", strconv.FormatBool(valid))
+}
+
+func (cli *CommandLine) getUTXOProof(txID, path, nodeID string) {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := openChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+
+	proof, err := UTXOSet.Proof(ID)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+
+	err = ioutil.WriteFile(path, proof.Serialize(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	printUTXOProof(proof)
+	fmt.Printf("Proof written to %s\n", path)
+}
+
+func (cli *CommandLine) verifyUTXOProof(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	proof, err := blockchain.DeserializeUTXOProof(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	printUTXOProof(proof)
+}
+
+func printUTXOProof(proof *blockchain.UTXOProof) {
+	header, err := blockchain.Deserialize(proof.Header)
+	handleError(err)
+
+	fmt.Printf("Transaction: %x\n", proof.TxID)
+	fmt.Printf("Block: %x\n", header.Hash)
+	fmt.Printf("Height: %d\n", header.Height)
+	fmt.Printf("UTXO root: %x\n", header.UTXORoot)
+	for i, out := range proof.Outputs.Outputs {
+		fmt.Printf("Output %d: %d coins to %x\n", proof.Outputs.Index(i), out.Value, out.PubKeyHash)
+	}
+
+	if err := proof.Verify(); err != nil {
+		fmt.Printf("Proof valid: false (%s)\n", err)
+		return
+	}
+	fmt.Println("Proof valid: true")
+}
+
+func (cli *CommandLine) exportChain(path string, from, to int, nodeID string) {
+	chain := openChain(nodeID)
+	defer chain.Database.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	count, err := chain.ExportBlocks(writer, from, to)
+	if err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	if err := writer.Flush(); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Done! %d blocks written to %s\n", count, path)
+}
+
+/*
+	A block that can't be read or fails the validation stops the import and ends the program with a
+	non-zero exit code, so scripts can tell. The blocks before it stay imported
+*/
+func (cli *CommandLine) importChain(path, nodeID string) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var chain *blockchain.Blockchain
+	imported, skipped := 0, 0
+
+	fail := func(err error) {
+		fmt.Println(err)
+		fmt.Printf("Import stopped! %d blocks imported, %d already known\n", imported, skipped)
+		if chain != nil {
+			chain.Database.Close()
+		}
+		os.Exit(1)
+	}
+
+	for {
+		block, err := blockchain.ReadBlock(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fail(err)
+		}
+
+		// A node without a chain is created from the genesis block at the start of the file
+		if chain == nil && !blockchain.ChainExists(nodeID) {
+			chain, err = blockchain.InitBlockchainFromGenesis(block, nodeID)
+			if err != nil {
+				fail(err)
+			}
+			defer chain.Database.Close()
+
+			fmt.Printf("Imported genesis %x\n", block.Hash)
+			imported++
+			continue
+		} else if chain == nil {
+			chain = openChain(nodeID)
+			defer chain.Database.Close()
+		}
+
+		added, err := chain.ImportBlock(block)
+		if err != nil {
+			fail(err)
+		}
+		if added {
+			fmt.Printf("Imported block %d %x\n", block.Height, block.Hash)
+			imported++
+		} else {
+			skipped++
+		}
+	}
+
+	if chain == nil {
+		fmt.Println("No blocks found in the file")
+		return
+	}
+	height, err := chain.GetBestHeight()
+	handleError(err)
+	fmt.Printf("Done! %d blocks imported, %d already known, tip at height %d\n", imported, skipped, height)
+}
+
+func (cli *CommandLine) dumpUTXO(path string, height int, nodeID string) {
+	chain := openChain(nodeID)
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+
+	snapshot, err := UTXOSet.Snapshot(height)
+	handleError(err)
+	err = ioutil.WriteFile(path, snapshot.Serialize(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Height: %d\n", snapshot.Height)
+	fmt.Printf("Block: %x\n", snapshot.BlockHash)
+	fmt.Printf("UTXO hash: %x\n", snapshot.Hash)
+	fmt.Printf("Done! %d transactions written to %s\n", len(snapshot.Entries), path)
+}
+
+func (cli *CommandLine) loadUTXO(path, nodeID string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	snapshot, err := blockchain.DeserializeSnapshot(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if err := snapshot.Verify(); err != nil {
+		fmt.Println(err)
+		fmt.Printf("Snapshot at height %d: block %x, UTXO hash %x\n", snapshot.Height, snapshot.BlockHash, snapshot.Hash)
+		runtime.Goexit()
+	}
+
+	chain, err := blockchain.LoadSnapshot(snapshot, nodeID)
+	handleError(err)
+	defer chain.Database.Close()
+
+	fmt.Printf("Done! Node bootstrapped at height %d with %d transactions in the UTXO set\n", snapshot.Height, len(snapshot.Entries))
+}
+
+// The memory pool lives in the running node, so the command goes to it through its control socket
+func (cli *CommandLine) saveMempool(nodeID string) {
+	handleError(network.SendSaveMempool(nodeID))
+	fmt.Printf("Node %s saved its memory pool to %s\n", nodeID, datadir.MempoolFile(nodeID))
+}
+
+func (cli *CommandLine) setMining(nodeID string, active bool) {
+	handleError(network.SendSetMining(nodeID, active))
+	if active {
+		fmt.Printf("Node %s resumed mining\n", nodeID)
+	} else {
+		fmt.Printf("Node %s paused mining\n", nodeID)
+	}
+}
+
+// A reference external miner, it asks for new work after every batch so it follows the tip and the pool
+func (cli *CommandLine) externalMiner(address string, batch int64) {
+	client, err := mining.DialWork(address)
+	handleError(err)
+	defer client.Close()
+
+	fmt.Printf("Mining for the node at %s\n", address)
+	for {
+		work, err := client.GetWork()
+		handleError(err)
+
+		nonce, found, err := mining.Solve(work, 0, batch)
+		handleError(err)
+		if !found {
+			continue
+		}
+
+		result, err := client.SubmitBlock(work.JobID, nonce)
+		if err != nil {
+			fmt.Printf("Block %d rejected: %s\n", work.Height, err)
+			continue
+		}
+		fmt.Printf("Block %d found: %s with %d transactions paying %d in fees\n", result.Height, result.Hash, work.Transactions, work.Fees)
+	}
+}
+
+func (cli *CommandLine) getMempoolInfo(nodeID string) {
+	path := datadir.MempoolFile(nodeID)
+	info, saved, err := mempool.ReadInfo(path)
+	if os.IsNotExist(err) {
+		fmt.Printf("Node %s has not saved its memory pool yet\n", nodeID)
+		return
+	}
+	handleError(err)
+
+	fmt.Printf("Memory pool saved at %s\n", saved.Format(time.RFC3339))
+	fmt.Printf("Transactions: %d\n", info.Count)
+	fmt.Printf("Size: %d bytes\n", info.Size)
+	fmt.Printf("Fees: %d\n", info.Fees)
+	if info.Count > 0 {
+		fmt.Printf("Oldest transaction: %s\n", info.Oldest.Format(time.RFC3339))
+	}
+}
+
+// The template is built by the running node, with its memory pool as it is right now
+func (cli *CommandLine) getBlockTemplate(minerAddress string, maxSize int, nodeID string) {
+	if !wallet.ValidateAddress(minerAddress) {
+		log.Panic("Address is not Valid")
+	}
+
+	template, err := network.GetBlockTemplate(nodeID, minerAddress, maxSize)
+	handleError(err)
+
+	fmt.Printf("Block %d on top of %s\n", template.Height, template.PrevHash)
+	fmt.Printf("Coinbase pays %d to %s\n", template.Reward, minerAddress)
+	fmt.Printf("Transactions: %d, %d bytes, %d in fees\n", len(template.Transactions), template.Size, template.Fees)
+	for _, tx := range template.Transactions {
+		fmt.Printf("  %s fee %d size %d rate %.4f\n", tx.ID, tx.Fee, tx.Size, tx.FeeRate)
+	}
 }
 
 func (cli *CommandLine) Run() {
-	cli.validateArgs()
+	// Options shared by all the commands go before the command name
+	globalCmd := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	globalCmd.Usage = cli.printUsage
+	dataDir := globalCmd.String("datadir", datadir.RootFromEnv(), "Root directory of the data of the nodes")
+	if err := globalCmd.Parse(os.Args[1:]); err != nil {
+		log.Panic(err)
+	}
+	datadir.Root = *dataDir
+
+	args := globalCmd.Args()
+	cli.validateArgs(args)
 
 	nodeID := os.Getenv("NODE_ID")
 	if nodeID == "" {
 		fmt.Printf("NODE_ID env is not set!")
 		runtime.Goexit()
 	}
+	moved, err := datadir.Migrate(nodeID)
+	for _, path := range moved {
+		fmt.Printf("Moved the data of the node from the old layout to %s\n", path)
+	}
+	if err != nil {
+		fmt.Printf("Failed to move the data of the node to %s: %s\n", datadir.NodeDir(nodeID), err)
+		runtime.Goexit()
+	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
@@ -178,54 +779,193 @@ func (cli *CommandLine) Run() {
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	timestampCmd := flag.NewFlagSet("timestamp", flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet("exportchain", flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet("importchain", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
+	verifyTimestampCmd := flag.NewFlagSet("verifytimestamp", flag.ExitOnError)
+	getUTXOProofCmd := flag.NewFlagSet("getutxoproof", flag.ExitOnError)
+	verifyUTXOProofCmd := flag.NewFlagSet("verifyutxoproof", flag.ExitOnError)
+	saveMempoolCmd := flag.NewFlagSet("savemempool", flag.ExitOnError)
+	getMempoolInfoCmd := flag.NewFlagSet("getmempoolinfo", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	getBlockTemplateCmd := flag.NewFlagSet("getblocktemplate", flag.ExitOnError)
+	estimateFeeCmd := flag.NewFlagSet("estimatefee", flag.ExitOnError)
+	pauseMiningCmd := flag.NewFlagSet("pausemining", flag.ExitOnError)
+	resumeMiningCmd := flag.NewFlagSet("resumemining", flag.ExitOnError)
+	minerCmd := flag.NewFlagSet("miner", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockchainRegtest := createBlockchainCmd.Bool("regtest", false, "Create the regtest chain, whose genesis is the same on every node")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendSigHash := sendCmd.String("sighash", "ALL", "Signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	sendFee := sendCmd.Int("fee", -1, "Fee paid to the miner, estimated from the recent blocks when it is not given")
+	sendBlocks := sendCmd.Int("blocks", 6, "Blocks within which the transaction should be mined when the fee is estimated")
+	estimateFeeBlocks := estimateFeeCmd.Int("blocks", 6, "Blocks within which the transaction should be mined")
+	sendReplaceable := sendCmd.Bool("rbf", false, "Allow the transaction to be replaced by one paying a higher fee until it is mined")
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "ID of the transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "Fee paid by the replacement")
+	createWalletType := createWalletCmd.String("type", "p256", "Signature scheme of the wallet: p256 or ed25519")
+	verifyChainDepth := verifyChainCmd.Int("depth", 0, "Number of blocks below the tip whose signatures are checked, 0 checks all of them")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodePrune := startNodeCmd.Int("prune", 0, "Keep only the last N full blocks, 0 keeps all of them")
+	startNodeBlockMaxSize := startNodeCmd.Int("blockmaxsize", mining.DefaultMaxBlockSize, "Maximum size in bytes of the blocks mined by the node")
+	startNodeTrigger := startNodeCmd.String("trigger", mining.DefaultTriggerPolicy.Trigger.String(), "When the miner mines a block: count, interval or continuous")
+	startNodeMinTxs := startNodeCmd.Int("mintxs", mining.DefaultTriggerPolicy.MinTxs, "Transactions waiting before a block is mined with -trigger count")
+	startNodeWorkAddress := startNodeCmd.String("workaddr", "", "Serve work to external miners on ADDRESS, like localhost:8333, needs -miner")
+	minerNode := minerCmd.String("node", "", "Address where the node serves work")
+	minerBatch := minerCmd.Int64("batch", 1<<20, "Nonces tried before asking for new work")
+	startNodeInterval := startNodeCmd.Duration("interval", mining.DefaultTriggerPolicy.Interval, "Time between blocks with -trigger interval")
+	getBlockTemplateMiner := getBlockTemplateCmd.String("miner", "", "Address receiving the coinbase")
+	getBlockTemplateMaxSize := getBlockTemplateCmd.Int("maxsize", mining.DefaultMaxBlockSize, "Maximum size in bytes of the block")
+	startNodeRegtest := startNodeCmd.Bool("regtest", false, "Run the node on the regtest chain kept in memory, it starts from the regtest genesis every time")
+	startNodeDataCarrierSize := startNodeCmd.Int("datacarriersize", mempool.DefaultPolicy.MaxDataCarrierSize, "Maximum size in bytes of the data of the data-carrier outputs relayed and mined")
+	exportChainOut := exportChainCmd.String("out", "", "File to write the blocks to")
+	exportChainFrom := exportChainCmd.Int("from", 0, "Height of the first block")
+	exportChainTo := exportChainCmd.Int("to", -1, "Height of the last block, the tip by default")
+	importChainIn := importChainCmd.String("in", "", "Bootstrap file")
+	dumpUTXOOut := dumpUTXOCmd.String("out", "", "File to write the snapshot to")
+	dumpUTXOHeight := dumpUTXOCmd.Int("height", -1, "Height of the block after which the UTXO set is taken, the tip by default")
+	loadUTXOIn := loadUTXOCmd.String("in", "", "Snapshot file")
+	timestampFile := timestampCmd.String("file", "", "File to timestamp")
+	timestampFrom := timestampCmd.String("from", "", "Wallet address paying the transaction")
+	timestampMine := timestampCmd.Bool("mine", false, "Mine immediately on the same node")
+	verifyTimestampFile := verifyTimestampCmd.String("file", "", "Timestamped file")
+	verifyTimestampTxID := verifyTimestampCmd.String("txid", "", "ID of the transaction with the hash of the file")
+	getUTXOProofTxID := getUTXOProofCmd.String("txid", "", "ID of the transaction")
+	getUTXOProofOut := getUTXOProofCmd.String("out", "", "File to write the proof to")
+	verifyUTXOProofIn := verifyUTXOProofCmd.String("in", "", "Proof file")
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "reindexutxo":
-		err := reindexUTXOCmd.Parse(os.Args[2:])
+		err := reindexUTXOCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
+		err := getBalanceCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
+		err := createBlockchainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "startnode":
-		err := startNodeCmd.Parse(os.Args[2:])
+		err := startNodeCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
+		err := listAddressesCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
+		err := createWalletCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifychain":
+		err := verifyChainCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "timestamp":
+		err := timestampCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifytimestamp":
+		err := verifyTimestampCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getutxoproof":
+		err := getUTXOProofCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifyutxoproof":
+		err := verifyUTXOProofCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "exportchain":
+		err := exportChainCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importchain":
+		err := importChainCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumputxo":
+		err := dumpUTXOCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadutxo":
+		err := loadUTXOCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "savemempool":
+		err := saveMempoolCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "pausemining":
+		err := pauseMiningCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "resumemining":
+		err := resumeMiningCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "miner":
+		err := minerCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getmempoolinfo":
+		err := getMempoolInfoCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "estimatefee":
+		err := estimateFeeCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getblocktemplate":
+		err := getBlockTemplateCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
@@ -243,6 +983,10 @@ func (cli *CommandLine) Run() {
 	}
 
 	if createBlockchainCmd.Parsed() {
+		if *createBlockchainRegtest {
+			cli.createRegtestChain(nodeID)
+			runtime.Goexit()
+		}
 		if *createBlockchainAddress == "" {
 			createBlockchainCmd.Usage()
 			runtime.Goexit()
@@ -255,7 +999,7 @@ func (cli *CommandLine) Run() {
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		cli.createWallet(*createWalletType, nodeID)
 	}
 	if listAddressesCmd.Parsed() {
 		cli.listAddresses(nodeID)
@@ -263,14 +1007,125 @@ func (cli *CommandLine) Run() {
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
+	if verifyChainCmd.Parsed() {
+		cli.verifyChain(*verifyChainDepth, nodeID)
+	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < -1 || *sendBlocks < 1 || *sendBlocks > mempool.MaxConfirmTarget {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendBlocks, *sendSigHash, nodeID, *sendReplaceable, *sendMine)
+	}
+
+	if estimateFeeCmd.Parsed() {
+		cli.estimateFee(*estimateFeeBlocks, nodeID)
+	}
+
+	if getBlockTemplateCmd.Parsed() {
+		if *getBlockTemplateMiner == "" || *getBlockTemplateMaxSize <= 0 {
+			getBlockTemplateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getBlockTemplate(*getBlockTemplateMiner, *getBlockTemplateMaxSize, nodeID)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeFee <= 0 {
+			bumpFeeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID)
+	}
+
+	if getUTXOProofCmd.Parsed() {
+		if *getUTXOProofTxID == "" || *getUTXOProofOut == "" {
+			getUTXOProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getUTXOProof(*getUTXOProofTxID, *getUTXOProofOut, nodeID)
+	}
+
+	if verifyUTXOProofCmd.Parsed() {
+		if *verifyUTXOProofIn == "" {
+			verifyUTXOProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.verifyUTXOProof(*verifyUTXOProofIn)
+	}
+
+	if exportChainCmd.Parsed() {
+		if *exportChainOut == "" || *exportChainFrom < 0 {
+			exportChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.exportChain(*exportChainOut, *exportChainFrom, *exportChainTo, nodeID)
+	}
+
+	if importChainCmd.Parsed() {
+		if *importChainIn == "" {
+			importChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importChain(*importChainIn, nodeID)
+	}
+
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOOut == "" {
+			dumpUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.dumpUTXO(*dumpUTXOOut, *dumpUTXOHeight, nodeID)
+	}
+
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOIn == "" {
+			loadUTXOCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.loadUTXO(*loadUTXOIn, nodeID)
+	}
+
+	if saveMempoolCmd.Parsed() {
+		cli.saveMempool(nodeID)
+	}
+
+	if pauseMiningCmd.Parsed() {
+		cli.setMining(nodeID, false)
+	}
+
+	if resumeMiningCmd.Parsed() {
+		cli.setMining(nodeID, true)
+	}
+
+	if minerCmd.Parsed() {
+		if *minerNode == "" || *minerBatch <= 0 {
+			minerCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.externalMiner(*minerNode, *minerBatch)
+	}
+
+	if getMempoolInfoCmd.Parsed() {
+		cli.getMempoolInfo(nodeID)
+	}
+
+	if timestampCmd.Parsed() {
+		if *timestampFile == "" || *timestampFrom == "" {
+			timestampCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.timestamp(*timestampFile, *timestampFrom, nodeID, *timestampMine)
+	}
+
+	if verifyTimestampCmd.Parsed() {
+		if *verifyTimestampFile == "" || *verifyTimestampTxID == "" {
+			verifyTimestampCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.verifyTimestamp(*verifyTimestampFile, *verifyTimestampTxID, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -279,6 +1134,28 @@ func (cli *CommandLine) Run() {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
+		if *startNodePrune != 0 && *startNodePrune < blockchain.MinPruneDepth {
+			fmt.Printf("-prune must be 0 or at least %d\n", blockchain.MinPruneDepth)
+			runtime.Goexit()
+		}
+		if *startNodeDataCarrierSize < 0 || *startNodeDataCarrierSize > blockchain.MaxDataCarrierSize {
+			fmt.Printf("-datacarriersize must be between 0 and %d\n", blockchain.MaxDataCarrierSize)
+			runtime.Goexit()
+		}
+		network.MempoolPolicy.MaxDataCarrierSize = *startNodeDataCarrierSize
+		network.PruneDepth = *startNodePrune
+		network.MaxBlockSize = *startNodeBlockMaxSize
+
+		trigger, err := mining.ParseTrigger(*startNodeTrigger)
+		handleError(err)
+		network.MiningPolicy = mining.TriggerPolicy{Trigger: trigger, MinTxs: *startNodeMinTxs, Interval: *startNodeInterval}
+		handleError(network.MiningPolicy.Validate())
+		if *startNodeWorkAddress != "" && *startNodeMiner == "" {
+			fmt.Println("-workaddr needs -miner, the address paid by the blocks of the external miners")
+			runtime.Goexit()
+		}
+		network.WorkAddress = *startNodeWorkAddress
+		network.Regtest = *startNodeRegtest
 		cli.StartNode(nodeID, *startNodeMiner)
 	}
 }
@@ -0,0 +1,109 @@
+package datadir
+
+import (
+	"os"
+	"path/filepath"
+)
+
+/*
+	Every node keeps its data in its own directory under the root, so several nodes can share it:
+
+	ROOT/node_ID/blocks        Badger database with the blocks and the UTXO set
+	ROOT/node_ID/wallets.data  Wallets of the node
+	ROOT/node_ID/peers.data    Known peers
+	ROOT/node_ID/mempool.data  Transactions of the memory pool saved when the node stops
+	ROOT/node_ID/fees.data     Fee estimates, saved with the memory pool
+	ROOT/node_ID/control.sock  Socket the commands use to drive the running node
+*/
+const (
+	DefaultRoot = "./tmp"
+	RootEnv     = "DATA_DIR" // Used when -datadir is not given
+
+	blocksDir   = "blocks"
+	walletsFile = "wallets.data"
+	peersFile   = "peers.data"
+	mempoolFile = "mempool.data"
+	feesFile    = "fees.data"
+	controlFile = "control.sock"
+)
+
+var Root = DefaultRoot // Set once at startup, before any path is built
+
+// The root from the environment, or the default one when it isn't set
+func RootFromEnv() string {
+	if root := os.Getenv(RootEnv); root != "" {
+		return root
+	}
+
+	return DefaultRoot
+}
+
+func NodeDir(nodeID string) string {
+	return filepath.Join(Root, "node_"+nodeID)
+}
+
+func BlocksDir(nodeID string) string {
+	return filepath.Join(NodeDir(nodeID), blocksDir)
+}
+
+func WalletsFile(nodeID string) string {
+	return filepath.Join(NodeDir(nodeID), walletsFile)
+}
+
+func PeersFile(nodeID string) string {
+	return filepath.Join(NodeDir(nodeID), peersFile)
+}
+
+func MempoolFile(nodeID string) string {
+	return filepath.Join(NodeDir(nodeID), mempoolFile)
+}
+
+func FeeEstimatesFile(nodeID string) string {
+	return filepath.Join(NodeDir(nodeID), feesFile)
+}
+
+func ControlSocket(nodeID string) string {
+	return filepath.Join(NodeDir(nodeID), controlFile)
+}
+
+// Creates the directory of the node and its parents, the blocks database creates its own directory
+func Create(nodeID string) error {
+	return os.MkdirAll(NodeDir(nodeID), 0700)
+}
+
+/*
+	Moves the blocks and the wallets of a node kept in the layout used before every node had its own
+	directory, ROOT/blocks_ID and ROOT/wallets_ID.data. A path is only moved when the new one doesn't
+	exist, so the data already in the directory of the node is never overwritten. Returns the new
+	paths of the data that was moved
+*/
+func Migrate(nodeID string) ([]string, error) {
+	var moved []string
+
+	moves := []struct{ from, to string }{
+		{filepath.Join(Root, "blocks_"+nodeID), BlocksDir(nodeID)},
+		{filepath.Join(Root, "wallets_"+nodeID+".data"), WalletsFile(nodeID)},
+	}
+	for _, move := range moves {
+		if _, err := os.Stat(move.from); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return moved, err
+		}
+		if _, err := os.Stat(move.to); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return moved, err
+		}
+
+		if err := Create(nodeID); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(move.from, move.to); err != nil {
+			return moved, err
+		}
+		moved = append(moved, move.to)
+	}
+
+	return moved, nil
+}
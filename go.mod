@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/dgraph-io/badger v1.5.4
 	github.com/mr-tron/base58 v1.1.0
+	github.com/vrecan/death/v3 v3.0.3
 	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 )
 
@@ -14,7 +15,6 @@ require (
 	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/pkg/errors v0.8.0 // indirect
 	github.com/stretchr/testify v1.8.1 // indirect
-	github.com/vrecan/death/v3 v3.0.3 // indirect
 	golang.org/x/net v0.0.0-20190311183353-d8887717615a // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.4.0 // indirect
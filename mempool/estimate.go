@@ -0,0 +1,208 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+)
+
+/*
+	The fee estimator learns what fee rates get mined how fast. Every transaction that entered the
+	pool while the node was running is put in a bucket by its fee rate when it leaves: a mined one
+	is counted as confirmed after the blocks it waited, an expired or evicted one as never confirmed.
+	Old data counts less and less, every block multiplies all the counts by decay.
+
+	The estimate for N blocks walks the buckets from the highest fee rate down, grouping them until
+	a group has enough transactions, and goes on while most transactions of each group confirmed
+	within N blocks. The average fee rate of the last group that passed is the estimate
+*/
+
+const (
+	MaxConfirmTarget = 48     // Highest number of blocks an estimate can be asked for
+	minBucketRate    = 0.0001 // Fee per byte of the lowest bucket above the one of the zero fee rates
+	maxBucketRate    = 10.0   // Fee per byte of the highest bucket
+	bucketSpacing    = 1.2    // Each bucket starts at a fee rate this much higher than the previous one
+	decay            = 0.998  // Weight left to the data after every block
+	minSamples       = 0.5    // Decayed transactions a group of buckets needs before it is judged
+	successRate      = 0.85   // Share of the transactions of a group that must confirm in time
+	estimatesVersion = 1      // Version of the fee estimates file, files of other versions are not loaded
+)
+
+var ErrNoEstimate = errors.New("Not enough transactions were mined yet to estimate the fee")
+
+type feeBucket struct {
+	Start     float64   // Lowest fee rate of the bucket
+	Txs       float64   // Transactions counted, decayed
+	RateSum   float64   // Sum of their fee rates, decayed
+	Confirmed []float64 // Confirmed[i] are the transactions mined within i+1 blocks, decayed
+}
+
+type FeeEstimator struct {
+	mutex   sync.RWMutex
+	buckets []*feeBucket
+}
+
+type savedEstimates struct {
+	Version int
+	Buckets []*feeBucket
+}
+
+func NewFeeEstimator() *FeeEstimator {
+	est := &FeeEstimator{}
+
+	est.buckets = append(est.buckets, newFeeBucket(0))
+	for rate := minBucketRate; rate <= maxBucketRate; rate *= bucketSpacing {
+		est.buckets = append(est.buckets, newFeeBucket(rate))
+	}
+
+	return est
+}
+
+func newFeeBucket(start float64) *feeBucket {
+	return &feeBucket{Start: start, Confirmed: make([]float64, MaxConfirmTarget)}
+}
+
+// The bucket with the highest start not above the fee rate
+func (est *FeeEstimator) bucketFor(rate float64) *feeBucket {
+	index := 0
+	for i, bucket := range est.buckets {
+		if bucket.Start <= rate {
+			index = i
+		}
+	}
+
+	return est.buckets[index]
+}
+
+// Counts the transactions mined in a block, with the blocks each of them waited, and ages the old data
+func (est *FeeEstimator) processBlock(mined map[*TxDesc]int) {
+	est.mutex.Lock()
+	defer est.mutex.Unlock()
+
+	for _, bucket := range est.buckets {
+		bucket.Txs *= decay
+		bucket.RateSum *= decay
+		for i := range bucket.Confirmed {
+			bucket.Confirmed[i] *= decay
+		}
+	}
+
+	for desc, blocks := range mined {
+		bucket := est.bucketFor(desc.FeeRate())
+		bucket.Txs++
+		bucket.RateSum += desc.FeeRate()
+		// A transaction that waited longer than the highest target only counts as not confirmed in time
+		for i := blocks - 1; i < MaxConfirmTarget; i++ {
+			bucket.Confirmed[i]++
+		}
+	}
+}
+
+// Counts a transaction that left the pool without being mined
+func (est *FeeEstimator) failed(desc *TxDesc) {
+	est.mutex.Lock()
+	defer est.mutex.Unlock()
+
+	bucket := est.bucketFor(desc.FeeRate())
+	bucket.Txs++
+	bucket.RateSum += desc.FeeRate()
+}
+
+// Returns the fee per byte likely to get a transaction mined within the given number of blocks
+func (est *FeeEstimator) EstimateFee(blocks int) (float64, error) {
+	if blocks < 1 || blocks > MaxConfirmTarget {
+		return 0, fmt.Errorf("The number of blocks must be between 1 and %d", MaxConfirmTarget)
+	}
+
+	est.mutex.RLock()
+	defer est.mutex.RUnlock()
+
+	estimate := math.NaN()
+	var txs, rateSum, confirmed float64
+
+	for i := len(est.buckets) - 1; i >= 0; i-- {
+		bucket := est.buckets[i]
+		txs += bucket.Txs
+		rateSum += bucket.RateSum
+		confirmed += bucket.Confirmed[blocks-1]
+
+		if txs < minSamples {
+			continue
+		}
+		if confirmed/txs < successRate {
+			break
+		}
+
+		estimate = rateSum / txs
+		txs, rateSum, confirmed = 0, 0, 0
+	}
+
+	if math.IsNaN(estimate) {
+		return 0, ErrNoEstimate
+	}
+
+	return estimate, nil
+}
+
+// Writes the data of the estimator next to the old file and renames it, like the memory pool
+func (est *FeeEstimator) Save(path string) error {
+	est.mutex.RLock()
+	saved := savedEstimates{Version: estimatesVersion, Buckets: est.buckets}
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(saved)
+	est.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".new"
+	if err := ioutil.WriteFile(tmpPath, content.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Replaces the data of the estimator with the one saved in the file, a missing file keeps it empty
+func (est *FeeEstimator) Load(path string) error {
+	loaded, err := ReadFeeEstimator(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	est.mutex.Lock()
+	defer est.mutex.Unlock()
+	est.buckets = loaded.buckets
+
+	return nil
+}
+
+// Reads the estimates saved by a node, so a wallet can estimate fees without the node
+func ReadFeeEstimator(path string) (*FeeEstimator, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved savedEstimates
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&saved); err != nil {
+		return nil, err
+	}
+	if saved.Version != estimatesVersion {
+		return nil, fmt.Errorf("Fee estimates file version %d is not supported", saved.Version)
+	}
+	for _, bucket := range saved.Buckets {
+		if len(bucket.Confirmed) != MaxConfirmTarget {
+			return nil, fmt.Errorf("Fee estimates file has %d targets instead of %d", len(bucket.Confirmed), MaxConfirmTarget)
+		}
+	}
+
+	return &FeeEstimator{buckets: saved.Buckets}, nil
+}
@@ -0,0 +1,119 @@
+package mempool
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestBucketFor(t *testing.T) {
+	est := NewFeeEstimator()
+	last := est.buckets[len(est.buckets)-1]
+
+	tests := []struct {
+		name  string
+		rate  float64
+		start float64
+	}{
+		{"zero fee", 0, 0},
+		{"below the lowest bucket", minBucketRate / 2, 0},
+		{"start of the lowest bucket", minBucketRate, minBucketRate},
+		{"inside a bucket", minBucketRate * bucketSpacing * 1.1, minBucketRate * bucketSpacing},
+		{"above the highest bucket", maxBucketRate * 100, last.Start},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if start := est.bucketFor(test.rate).Start; math.Abs(start-test.start) > 1e-12 {
+				t.Fatalf("Fee rate %g went to the bucket starting at %g, expected %g", test.rate, start, test.start)
+			}
+		})
+	}
+}
+
+// Transactions paying fee per byte that left the pool after waiting blocks, never mined when blocks is 0
+type feeSample struct {
+	count  int
+	fee    int
+	blocks int
+}
+
+func TestEstimateFee(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []feeSample
+		target   int
+		estimate float64 // Not checked when err is set
+		err      error
+	}{
+		{"no data", nil, 1, 0, ErrNoEstimate},
+		{"mined in the next block", []feeSample{{10, 2, 1}}, 1, 2, nil},
+		{"mined too late", []feeSample{{10, 2, 3}}, 1, 0, ErrNoEstimate},
+		{"mined in time", []feeSample{{10, 2, 3}}, 3, 2, nil},
+		{"higher fee mined faster", []feeSample{{10, 4, 1}, {10, 1, 5}}, 1, 4, nil},
+		{"lower fee mined in time too", []feeSample{{10, 4, 1}, {10, 1, 5}}, 5, 1, nil},
+		{"half never mined", []feeSample{{10, 2, 1}, {10, 2, 0}}, 1, 0, ErrNoEstimate},
+		{"too few never mined", []feeSample{{20, 2, 1}, {1, 2, 0}}, 1, 2, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			est := NewFeeEstimator()
+			for _, sample := range test.samples {
+				mined := make(map[*TxDesc]int)
+				for i := 0; i < sample.count; i++ {
+					desc := &TxDesc{Fee: sample.fee, Size: 1}
+					if sample.blocks == 0 {
+						est.failed(desc)
+					} else {
+						mined[desc] = sample.blocks
+					}
+				}
+				est.processBlock(mined)
+			}
+
+			estimate, err := est.EstimateFee(test.target)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("EstimateFee returned %v, expected %v", err, test.err)
+			}
+			if err == nil && math.Abs(estimate-test.estimate) > 0.01 {
+				t.Fatalf("Estimated %g, expected %g", estimate, test.estimate)
+			}
+		})
+	}
+
+	for _, target := range []int{0, MaxConfirmTarget + 1} {
+		if _, err := NewFeeEstimator().EstimateFee(target); err == nil {
+			t.Fatalf("Estimate for %d blocks accepted", target)
+		}
+	}
+}
+
+// Every block ages the data, a transaction mined long ago no longer gives an estimate alone
+func TestEstimatorDecay(t *testing.T) {
+	est := NewFeeEstimator()
+	est.processBlock(map[*TxDesc]int{{Fee: 2, Size: 1}: 1})
+	bucket := est.bucketFor(2)
+
+	blocks := 0
+	for ; ; blocks++ {
+		expected := math.Pow(decay, float64(blocks))
+		if math.Abs(bucket.Txs-expected) > 1e-9 || math.Abs(bucket.Confirmed[0]-expected) > 1e-9 {
+			t.Fatalf("After %d blocks the bucket counts %g transactions and %g confirmed, expected %g", blocks, bucket.Txs, bucket.Confirmed[0], expected)
+		}
+
+		_, err := est.EstimateFee(1)
+		if bucket.Txs < minSamples {
+			if !errors.Is(err, ErrNoEstimate) {
+				t.Fatalf("Estimate from %g transactions returned %v", bucket.Txs, err)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("After %d blocks: %s", blocks, err)
+		}
+		est.processBlock(nil)
+	}
+
+	if expected := int(math.Log(minSamples)/math.Log(decay)) + 1; blocks != expected {
+		t.Fatalf("The estimate lasted %d blocks, expected %d", blocks, expected)
+	}
+}
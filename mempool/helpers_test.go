@@ -0,0 +1,108 @@
+package mempool
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/blockchain-app-go/blockchain"
+	"github.com/blockchain-app-go/storage"
+	"github.com/blockchain-app-go/wallet"
+)
+
+func newTestWallet(t *testing.T) *wallet.Wallet {
+	t.Helper()
+
+	w, err := wallet.MakeWallet(wallet.P256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+func address(w *wallet.Wallet) string {
+	return string(w.Address())
+}
+
+// A chain in a memory store whose genesis block and next blocks pay the subsidy to the wallets, one block each
+func newTestChain(t *testing.T, wallets ...*wallet.Wallet) *blockchain.Blockchain {
+	t.Helper()
+
+	chain, err := blockchain.InitBlockchainInStore(address(wallets[0]), storage.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range wallets[1:] {
+		mineTestBlock(t, chain, w)
+	}
+
+	return chain
+}
+
+// Mines the transactions on the tip, the coinbase pays the subsidy and their fees to the wallet
+func mineTestBlock(t *testing.T, chain *blockchain.Blockchain, w *wallet.Wallet, txs ...*blockchain.Transaction) *blockchain.Block {
+	t.Helper()
+
+	fees := 0
+	for _, tx := range txs {
+		prevTxs, err := chain.GetPreviousTransactions(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fee, err := tx.Fee(prevTxs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fees += fee
+	}
+	coinbase, err := blockchain.CoinbaseTxWithFees(address(w), "", fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepared, err := chain.PrepareBlock(append([]*blockchain.Transaction{coinbase}, txs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := chain.SubmitBlock(prepared, solve(prepared))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// Finds the nonce of the block without printing every hash like Run does
+func solve(block *blockchain.Block) int {
+	var intHash big.Int
+
+	pow := blockchain.NewProof(block)
+	prefix := pow.HeaderPrefix()
+	for nonce := 0; ; nonce++ {
+		hash := sha256.Sum256(blockchain.PowData(prefix, int64(nonce), blockchain.Difficulty))
+		if intHash.SetBytes(hash[:]).Cmp(pow.Target) == -1 {
+			return nonce
+		}
+	}
+}
+
+// Sends amount from the wallet, spending the outputs of the view
+func newTestTx(t *testing.T, from, to *wallet.Wallet, amount, fee int, view blockchain.UTXOView) *blockchain.Transaction {
+	t.Helper()
+
+	tx, err := blockchain.NewTransaction(from, address(to), amount, fee, view)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func addTestTx(t *testing.T, mp *Mempool, tx *blockchain.Transaction) {
+	t.Helper()
+
+	if err := mp.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+}
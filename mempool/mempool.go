@@ -0,0 +1,519 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+var (
+	ErrAlreadyKnown  = errors.New("Transaction is already in the memory pool")
+	ErrCoinbase      = errors.New("Coinbase transactions are only valid in blocks")
+	ErrMissingInputs = errors.New("Transaction spends outputs that are not in the UTXO set")
+	ErrConflict      = errors.New("Transaction spends an output already spent in the memory pool")
+	ErrInvalid       = errors.New("Transaction has invalid signatures")
+	ErrNegativeFee   = errors.New("Transaction outputs are worth more than its inputs")
+	ErrNonStandard   = errors.New("Transaction is not standard")
+	ErrPoolFull      = errors.New("Memory pool is full and the fee rate is too low")
+	ErrTooLongChain  = errors.New("Transaction has too many unconfirmed ancestors or descendants")
+	ErrReplacement   = errors.New("Transaction can't replace the transactions it conflicts with")
+)
+
+// Reasons sent with the TxRemovedFromMempool events
+const (
+	ReasonMined    = "mined"
+	ReasonConflict = "conflict"
+	ReasonExpired  = "expired"
+	ReasonEvicted  = "evicted"
+	ReasonReplaced = "replaced"
+)
+
+// Number of blocks whose transactions were removed that the pool remembers, to remove them only once
+const recentBlocks = 100
+
+// A transaction in the pool together with what the pool knows about it
+type TxDesc struct {
+	Tx     *blockchain.Transaction
+	Added  time.Time
+	Size   int // Bytes of the serialized transaction
+	Fee    int // Value of the inputs not spent by the outputs
+	Height int // Height of the tip when the transaction entered the pool
+
+	parents  map[string]*TxDesc // Transactions of the pool with outputs spent by this one
+	children map[string]*TxDesc // Transactions of the pool spending outputs of this one
+	tracked  bool               // Seen by the fee estimator, the ones loaded from a file waited for unknown blocks
+}
+
+func (desc *TxDesc) FeeRate() float64 {
+	return float64(desc.Fee) / float64(desc.Size)
+}
+
+func (desc *TxDesc) rate() feeRate {
+	return feeRate{desc.Fee, desc.Size}
+}
+
+// Fee and size of one or more transactions
+type feeRate struct {
+	fee  int
+	size int
+}
+
+func (rate feeRate) add(desc *TxDesc) feeRate {
+	return feeRate{rate.fee + desc.Fee, rate.size + desc.Size}
+}
+
+// Compares the fee rates without dividing, so equal rates are always seen as equal
+func (rate feeRate) less(other feeRate) bool {
+	return rate.fee*other.size < other.fee*rate.size
+}
+
+func outpoint(txID []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txID, index)
+}
+
+/*
+	The memory pool keeps the transactions waiting to be mined. Every transaction is checked against
+	the UTXO set and the outputs of the transactions already in the pool before it is accepted, and
+	it can't spend an output spent by another one in the pool. It is safe to use from every
+	connection of the node at the same time
+*/
+type Mempool struct {
+	mutex     sync.RWMutex
+	chain     *blockchain.Blockchain
+	policy    Policy
+	txs       map[string]*TxDesc
+	spent     map[string]string // Outputs spent by the pool and the ID of the transaction spending them
+	size      int
+	estimator *FeeEstimator
+	blocks    map[string]bool // Recent blocks whose transactions were removed
+	blockList []string        // The same blocks, oldest first
+}
+
+func New(chain *blockchain.Blockchain, policy Policy) *Mempool {
+	return &Mempool{
+		chain:     chain,
+		policy:    policy,
+		txs:       make(map[string]*TxDesc),
+		spent:     make(map[string]string),
+		estimator: NewFeeEstimator(),
+		blocks:    make(map[string]bool),
+	}
+}
+
+// The fee estimator fed by the transactions leaving the pool
+func (mp *Mempool) Estimator() *FeeEstimator {
+	return mp.estimator
+}
+
+/*
+	Admits a transaction: it must be standard, spend only outputs of the UTXO set or of the pool
+	that nothing in the pool spends, unless it replaces the transactions spending them, and have
+	valid signatures. When the pool is full the transactions with the lowest fee rate are
+	evicted, as long as they pay less than the new one
+*/
+func (mp *Mempool) Add(tx *blockchain.Transaction) error {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	mp.expire(time.Now())
+
+	if err := mp.add(tx, time.Now()); err != nil {
+		return err
+	}
+	mp.txs[hex.EncodeToString(tx.ID)].tracked = true
+
+	return nil
+}
+
+// The caller must hold the write lock
+func (mp *Mempool) add(tx *blockchain.Transaction, added time.Time) error {
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := mp.txs[txID]; ok {
+		return ErrAlreadyKnown
+	}
+	if tx.IsCoinbase() {
+		return ErrCoinbase
+	}
+
+	desc := &TxDesc{Tx: tx, Added: added, Size: len(tx.Serialize())}
+	if err := mp.policy.checkStandard(tx, desc.Size); err != nil {
+		return err
+	}
+	height, err := mp.chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	desc.Height = height
+
+	desc.parents, desc.children = make(map[string]*TxDesc), make(map[string]*TxDesc)
+	prevTxs, err := mp.spendInputs(desc)
+	if err != nil {
+		return err
+	}
+	if desc.Fee < 0 {
+		return ErrNegativeFee
+	}
+
+	replaced, err := mp.replacementFor(desc)
+	if err != nil {
+		return err
+	}
+
+	ancestors := walk(desc.parents, parentsOf)
+	if len(ancestors)+1 > mp.policy.MaxAncestors {
+		return fmt.Errorf("%w: %d ancestors", ErrTooLongChain, len(ancestors))
+	}
+	for _, ancestor := range ancestors {
+		if len(walk(ancestor.children, childrenOf))+2 > mp.policy.MaxDescendants {
+			return fmt.Errorf("%w: %x has too many descendants", ErrTooLongChain, ancestor.Tx.ID)
+		}
+	}
+
+	// Verifying here stores the signatures in the cache so mining the transaction doesn't check them again
+	if !mp.chain.VerifyTransactionWith(tx, prevTxs) {
+		return ErrInvalid
+	}
+
+	evicted, err := mp.evictionFor(desc, ancestors, replaced)
+	if err != nil {
+		return err
+	}
+	for replacedID := range replaced {
+		mp.remove(replacedID, ReasonReplaced)
+	}
+	for _, victim := range evicted {
+		mp.removeWithDescendants(victim, ReasonEvicted)
+	}
+
+	mp.txs[txID] = desc
+	mp.size += desc.Size
+	for _, in := range tx.Inputs {
+		mp.spent[outpoint(in.ID, in.Out)] = txID
+	}
+	for _, parent := range desc.parents {
+		parent.children[txID] = desc
+	}
+	mp.chain.Events.Publish(blockchain.Event{Type: blockchain.TxAcceptedToMempool, Tx: tx})
+
+	return nil
+}
+
+/*
+	Finds the outputs spent by the inputs, first in the pool and then in the UTXO set. It sets the
+	fee and the parents of the transaction and returns the previous transactions of its inputs
+*/
+func (mp *Mempool) spendInputs(desc *TxDesc) (map[string]blockchain.Transaction, error) {
+	UTXOSet := blockchain.UTXOSet{Blockchain: mp.chain}
+	prevTxs := make(map[string]blockchain.Transaction)
+	inputs := 0
+
+	for _, in := range desc.Tx.Inputs {
+		key := outpoint(in.ID, in.Out)
+		inID := hex.EncodeToString(in.ID)
+		if parent, ok := mp.txs[inID]; ok {
+			outputs := parent.Tx.Outputs
+			if in.Out < 0 || in.Out >= len(outputs) || outputs[in.Out].IsDataCarrier() {
+				return nil, fmt.Errorf("%w: %s", ErrMissingInputs, key)
+			}
+			desc.parents[inID] = parent
+			prevTxs[inID] = *parent.Tx
+			inputs += outputs[in.Out].Value
+			continue
+		}
+
+		out, err := UTXOSet.FindOutput(in.ID, in.Out)
+		if errors.Is(err, blockchain.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrMissingInputs, key)
+		} else if err != nil {
+			return nil, err
+		}
+		inputs += out.Value
+
+		// The unspent outputs are all we need to verify the signature, so the chain is not searched
+		if _, ok := prevTxs[inID]; !ok {
+			prevTx, err := UTXOSet.FindTransaction(in.ID)
+			if err != nil {
+				return nil, err
+			}
+			prevTxs[inID] = prevTx
+		}
+	}
+
+	desc.Fee = inputs
+	for _, out := range desc.Tx.Outputs {
+		desc.Fee -= out.Value
+	}
+
+	return prevTxs, nil
+}
+
+/*
+	Picks the transactions to evict so the new one fits, once the transactions it replaces are gone.
+	A transaction is evicted with its descendants, which would spend missing outputs otherwise, and
+	the ancestors of the new transaction are never evicted. Nothing is evicted if the new
+	transaction doesn't pay more than the ones it would evict
+*/
+func (mp *Mempool) evictionFor(desc *TxDesc, ancestors, replaced map[string]*TxDesc) ([]string, error) {
+	if desc.Size > mp.policy.MaxSize {
+		return nil, ErrPoolFull
+	}
+
+	size := mp.size
+	for _, member := range replaced {
+		size -= member.Size
+	}
+	if size+desc.Size <= mp.policy.MaxSize {
+		return nil, nil
+	}
+
+	var candidates []*TxDesc
+	scores := make(map[*TxDesc]feeRate)
+	for txID, other := range mp.txs {
+		_, isAncestor := ancestors[txID]
+		_, isReplaced := replaced[txID]
+		if isAncestor || isReplaced {
+			continue
+		}
+		candidates = append(candidates, other)
+		scores[other] = mp.descendantScore(other)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return scores[candidates[i]].less(scores[candidates[j]])
+	})
+
+	var evicted []string
+	planned := make(map[string]bool)
+	for txID := range replaced {
+		planned[txID] = true
+	}
+	for _, candidate := range candidates {
+		if size+desc.Size <= mp.policy.MaxSize {
+			break
+		}
+
+		txID := hex.EncodeToString(candidate.Tx.ID)
+		if planned[txID] {
+			continue
+		}
+		if !scores[candidate].less(desc.rate()) {
+			return nil, ErrPoolFull
+		}
+
+		evicted = append(evicted, txID)
+		group := walk(candidate.children, childrenOf)
+		group[txID] = candidate
+		for groupID, member := range group {
+			if !planned[groupID] {
+				planned[groupID] = true
+				size -= member.Size
+			}
+		}
+	}
+
+	if size+desc.Size > mp.policy.MaxSize {
+		return nil, ErrPoolFull
+	}
+
+	return evicted, nil
+}
+
+// The caller must hold the write lock
+func (mp *Mempool) remove(txID, reason string) {
+	desc, ok := mp.txs[txID]
+	if !ok {
+		return
+	}
+
+	delete(mp.txs, txID)
+	mp.size -= desc.Size
+	for _, in := range desc.Tx.Inputs {
+		delete(mp.spent, outpoint(in.ID, in.Out))
+	}
+	for _, parent := range desc.parents {
+		delete(parent.children, txID)
+	}
+	for _, child := range desc.children {
+		delete(child.parents, txID)
+	}
+	if desc.tracked && (reason == ReasonExpired || reason == ReasonEvicted) {
+		mp.estimator.failed(desc)
+	}
+
+	mp.chain.Events.Publish(blockchain.Event{Type: blockchain.TxRemovedFromMempool, Tx: desc.Tx, Reason: reason})
+}
+
+// Removes the transaction and the ones spending its outputs, it returns how many were removed
+func (mp *Mempool) removeWithDescendants(txID, reason string) int {
+	desc, ok := mp.txs[txID]
+	if !ok {
+		return 0
+	}
+
+	descendants := walk(desc.children, childrenOf)
+	mp.remove(txID, reason)
+	for descendantID := range descendants {
+		mp.remove(descendantID, reason)
+	}
+
+	return len(descendants) + 1
+}
+
+// Removes the transaction, and its descendants too since they can't be mined without it
+func (mp *Mempool) Remove(txID []byte, reason string) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	mp.removeWithDescendants(hex.EncodeToString(txID), reason)
+}
+
+/*
+	Drops the transactions of a block connected to the chain and the ones that spend the same outputs.
+	The transactions spending outputs of the mined ones stay, their parents are confirmed now. The
+	fee estimator learns how many blocks the mined ones waited
+*/
+func (mp *Mempool) RemoveBlock(block *blockchain.Block) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	// The miner removes its blocks right away and the chain events report them again
+	blockHash := hex.EncodeToString(block.Hash)
+	if mp.blocks[blockHash] {
+		return
+	}
+	mp.blocks[blockHash] = true
+	mp.blockList = append(mp.blockList, blockHash)
+	if len(mp.blockList) > recentBlocks {
+		delete(mp.blocks, mp.blockList[0])
+		mp.blockList = mp.blockList[1:]
+	}
+
+	mined := make(map[*TxDesc]int)
+	for _, tx := range block.Transactions {
+		if desc, ok := mp.txs[hex.EncodeToString(tx.ID)]; ok && desc.tracked {
+			mined[desc] = block.Height - desc.Height
+			if mined[desc] < 1 {
+				mined[desc] = 1
+			}
+		}
+	}
+	mp.estimator.processBlock(mined)
+
+	for _, tx := range block.Transactions {
+		mp.remove(hex.EncodeToString(tx.ID), ReasonMined)
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if spender, ok := mp.spent[outpoint(in.ID, in.Out)]; ok {
+				mp.removeWithDescendants(spender, ReasonConflict)
+			}
+		}
+	}
+}
+
+/*
+	Puts back the transactions of a block disconnected when the chain switched to another branch. The
+	ones the new branch mined or made invalid are not accepted. Returns how many went back to the pool
+*/
+func (mp *Mempool) ReturnBlock(block *blockchain.Block) int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	// The block can be connected again if the chain switches back
+	delete(mp.blocks, hex.EncodeToString(block.Hash))
+
+	returned := 0
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() && mp.add(tx, time.Now()) == nil {
+			returned++
+		}
+	}
+
+	return returned
+}
+
+// Drops the transactions that were added before the expiry time of the policy, it returns how many
+func (mp *Mempool) Expire(now time.Time) int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	return mp.expire(now)
+}
+
+func (mp *Mempool) expire(now time.Time) int {
+	var expired []string
+	for txID, desc := range mp.txs {
+		if now.Sub(desc.Added) > mp.policy.Expiry {
+			expired = append(expired, txID)
+		}
+	}
+
+	removed := 0
+	for _, txID := range expired {
+		removed += mp.removeWithDescendants(txID, ReasonExpired)
+	}
+
+	return removed
+}
+
+func (mp *Mempool) Get(txID []byte) (*blockchain.Transaction, bool) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	desc, ok := mp.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+
+	return desc.Tx, true
+}
+
+func (mp *Mempool) Has(txID []byte) bool {
+	_, ok := mp.Get(txID)
+
+	return ok
+}
+
+// Number of transactions in the pool
+func (mp *Mempool) Count() int {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return len(mp.txs)
+}
+
+// Bytes of the transactions in the pool
+func (mp *Mempool) Size() int {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return mp.size
+}
+
+// Returns the transactions from the highest fee rate to the lowest, the oldest first when they pay the same
+func (mp *Mempool) ByFeeRate() []*TxDesc {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var descs []*TxDesc
+	for _, desc := range mp.txs {
+		descs = append(descs, desc)
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		if descs[j].rate().less(descs[i].rate()) {
+			return true
+		}
+		if descs[i].rate().less(descs[j].rate()) {
+			return false
+		}
+		return descs[i].Added.Before(descs[j].Added)
+	})
+
+	return descs
+}
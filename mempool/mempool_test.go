@@ -0,0 +1,136 @@
+package mempool
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blockchain-app-go/blockchain"
+	"github.com/blockchain-app-go/wallet"
+)
+
+func TestAddRejects(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	chain := newTestChain(t, alice, alice)
+	confirmed := blockchain.UTXOSet{Blockchain: chain}
+
+	tests := []struct {
+		name  string
+		setup func(mp *Mempool) *blockchain.Transaction // Fills the pool and returns the transaction to add
+		err   error
+	}{
+		{"already in the pool", func(mp *Mempool) *blockchain.Transaction {
+			tx := newTestTx(t, alice, bob, 5, 1, mp)
+			addTestTx(t, mp, tx)
+			return tx
+		}, ErrAlreadyKnown},
+		{"spends an output spent in the pool", func(mp *Mempool) *blockchain.Transaction {
+			addTestTx(t, mp, newTestTx(t, alice, bob, 5, 1, confirmed))
+			return newTestTx(t, alice, bob, 6, 1, confirmed)
+		}, ErrConflict},
+		{"spends a missing output", func(mp *Mempool) *blockchain.Transaction {
+			tx := newTestTx(t, alice, bob, 5, 1, confirmed)
+			tx.Inputs[0].Out = 7
+			return tx
+		}, ErrMissingInputs},
+		{"coinbase", func(mp *Mempool) *blockchain.Transaction {
+			tx, err := blockchain.CoinbaseTx(address(bob), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}, ErrCoinbase},
+		{"outputs worth more than the inputs", func(mp *Mempool) *blockchain.Transaction {
+			tx := newTestTx(t, alice, bob, 5, 1, confirmed)
+			tx.Outputs[0].Value += 100
+			return tx
+		}, ErrNegativeFee},
+		{"invalid signature", func(mp *Mempool) *blockchain.Transaction {
+			tx := newTestTx(t, alice, bob, 5, 1, confirmed)
+			tx.Outputs[0].Value--
+			return tx
+		}, ErrInvalid},
+		{"output without value", func(mp *Mempool) *blockchain.Transaction {
+			tx := newTestTx(t, alice, bob, 5, 1, confirmed)
+			tx.Outputs[0].Value = 0
+			return tx
+		}, ErrNonStandard},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp := New(chain, DefaultPolicy)
+			tx := test.setup(mp)
+			count := mp.Count()
+
+			if err := mp.Add(tx); !errors.Is(err, test.err) {
+				t.Fatalf("Add returned %v, expected %v", err, test.err)
+			}
+			if mp.Count() != count {
+				t.Fatal("The rejected transaction changed the pool")
+			}
+		})
+	}
+}
+
+// The pool holds two transactions, a third one goes in only by evicting the one paying the least with its descendants
+func TestEviction(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	carol := newTestWallet(t)
+	dave := newTestWallet(t)
+	chain := newTestChain(t, alice, bob, carol)
+
+	sample := newTestTx(t, alice, bob, 5, 1, blockchain.UTXOSet{Blockchain: chain})
+	policy := DefaultPolicy
+	policy.MaxSize = 2*len(sample.Serialize()) + 10
+
+	type send struct {
+		from *wallet.Wallet
+		fee  int
+	}
+	tests := []struct {
+		name    string
+		pool    []send // Added in this order before the new one, the second one of a wallet spends the change of the first
+		new     send
+		err     error
+		evicted []int // Indexes in pool of the transactions evicted for the new one
+	}{
+		{"room left", []send{{alice, 1}}, send{bob, 1}, nil, nil},
+		{"lowest fee rate evicted", []send{{alice, 1}, {bob, 3}}, send{carol, 2}, nil, []int{0}},
+		{"fee rate too low", []send{{alice, 2}, {bob, 3}}, send{carol, 2}, ErrPoolFull, nil},
+		{"only the lowest descendant evicted", []send{{alice, 2}, {alice, 1}}, send{bob, 2}, nil, []int{1}},
+		{"parent evicted with its child", []send{{alice, 0}, {alice, 1}}, send{bob, 2}, nil, []int{0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp := New(chain, policy)
+			var txs []*blockchain.Transaction
+			for _, s := range test.pool {
+				tx := newTestTx(t, s.from, dave, 5, s.fee, mp)
+				addTestTx(t, mp, tx)
+				txs = append(txs, tx)
+			}
+
+			tx := newTestTx(t, test.new.from, dave, 5, test.new.fee, mp)
+			if err := mp.Add(tx); !errors.Is(err, test.err) {
+				t.Fatalf("Add returned %v, expected %v", err, test.err)
+			}
+			if mp.Has(tx.ID) != (test.err == nil) {
+				t.Fatalf("New transaction in the pool: %t", mp.Has(tx.ID))
+			}
+
+			evicted := make(map[int]bool)
+			for _, i := range test.evicted {
+				evicted[i] = true
+			}
+			for i, old := range txs {
+				if mp.Has(old.ID) == evicted[i] {
+					t.Fatalf("Transaction %d in the pool: %t, evicted: %t", i, mp.Has(old.ID), evicted[i])
+				}
+			}
+			if mp.Size() > policy.MaxSize {
+				t.Fatalf("The pool holds %d bytes, more than %d", mp.Size(), policy.MaxSize)
+			}
+		})
+	}
+}
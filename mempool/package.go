@@ -0,0 +1,188 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"sort"
+)
+
+/*
+	A transaction spending an unconfirmed output can only be mined with, or after, the transaction
+	that created it. Its package is the transaction together with its unconfirmed ancestors, and
+	the fee rate of the whole package is what a miner gets for including it, so a child paying a
+	high fee makes a parent paying a low one worth mining
+*/
+
+func parentsOf(desc *TxDesc) map[string]*TxDesc {
+	return desc.parents
+}
+
+func childrenOf(desc *TxDesc) map[string]*TxDesc {
+	return desc.children
+}
+
+// Follows the links from the given transactions and returns all the transactions reached, them included
+func walk(start map[string]*TxDesc, links func(*TxDesc) map[string]*TxDesc) map[string]*TxDesc {
+	found := make(map[string]*TxDesc)
+	var pending []*TxDesc
+
+	for txID, desc := range start {
+		found[txID] = desc
+		pending = append(pending, desc)
+	}
+
+	for len(pending) > 0 {
+		desc := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		for txID, linked := range links(desc) {
+			if _, ok := found[txID]; !ok {
+				found[txID] = linked
+				pending = append(pending, linked)
+			}
+		}
+	}
+
+	return found
+}
+
+/*
+	Evicting a transaction evicts its descendants too, so it is only worth keeping as much as the
+	best of its own fee rate and the fee rate of the transaction with all its descendants
+*/
+func (mp *Mempool) descendantScore(desc *TxDesc) feeRate {
+	group := desc.rate()
+	for _, descendant := range walk(desc.children, childrenOf) {
+		group = group.add(descendant)
+	}
+
+	if desc.rate().less(group) {
+		return group
+	}
+
+	return desc.rate()
+}
+
+// Orders the transactions so the parents always go before their children, as they must in a block
+func sortTopological(descs []*TxDesc) {
+	depth := make(map[*TxDesc]int)
+	for _, desc := range descs {
+		depth[desc] = len(walk(desc.parents, parentsOf))
+	}
+
+	sort.SliceStable(descs, func(i, j int) bool {
+		return depth[descs[i]] < depth[descs[j]]
+	})
+}
+
+func toList(descs map[string]*TxDesc) []*TxDesc {
+	var list []*TxDesc
+	for _, desc := range descs {
+		list = append(list, desc)
+	}
+	sortTopological(list)
+
+	return list
+}
+
+// The unconfirmed transactions whose outputs the transaction spends, directly or not, parents first
+func (mp *Mempool) Ancestors(txID []byte) []*TxDesc {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	desc, ok := mp.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return nil
+	}
+
+	return toList(walk(desc.parents, parentsOf))
+}
+
+// The transactions of the pool that spend the outputs of the transaction, directly or not, parents first
+func (mp *Mempool) Descendants(txID []byte) []*TxDesc {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	desc, ok := mp.txs[hex.EncodeToString(txID)]
+	if !ok {
+		return nil
+	}
+
+	return toList(walk(desc.children, childrenOf))
+}
+
+// Returns the transaction with its unconfirmed ancestors in the order they can go in a block
+func (mp *Mempool) Package(txID []byte) []*TxDesc {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	key := hex.EncodeToString(txID)
+	desc, ok := mp.txs[key]
+	if !ok {
+		return nil
+	}
+
+	members := walk(desc.parents, parentsOf)
+	members[key] = desc
+
+	return toList(members)
+}
+
+/*
+	Selects the transactions of a block of at most maxBytes, 0 selects all of them. Every round
+	takes the transaction whose package, counting only the ancestors not selected yet, pays the
+	most per byte, and adds the whole package with the parents before the children
+*/
+func (mp *Mempool) Select(maxBytes int) []*TxDesc {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	selected := make(map[string]bool)
+	skipped := make(map[string]bool)
+	var descs []*TxDesc
+	size := 0
+
+	for {
+		var best *TxDesc
+		var bestPackage map[string]*TxDesc
+		var bestRate feeRate
+
+		for txID, desc := range mp.txs {
+			if selected[txID] || skipped[txID] {
+				continue
+			}
+
+			members := walk(desc.parents, parentsOf)
+			members[txID] = desc
+			rate := feeRate{}
+			for memberID, member := range members {
+				if selected[memberID] {
+					delete(members, memberID)
+					continue
+				}
+				rate = rate.add(member)
+			}
+
+			if best == nil || bestRate.less(rate) || (!rate.less(bestRate) && desc.Added.Before(best.Added)) {
+				best, bestPackage, bestRate = desc, members, rate
+			}
+		}
+
+		if best == nil {
+			break
+		}
+
+		// Its descendants have bigger packages, they are skipped in the next rounds too
+		if maxBytes > 0 && size+bestRate.size > maxBytes {
+			skipped[hex.EncodeToString(best.Tx.ID)] = true
+			continue
+		}
+
+		for _, member := range toList(bestPackage) {
+			selected[hex.EncodeToString(member.Tx.ID)] = true
+			descs = append(descs, member)
+		}
+		size += bestRate.size
+	}
+
+	return descs
+}
@@ -0,0 +1,62 @@
+package mempool
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+// A child paying a high fee gets its parent paying nothing mined before a transaction paying a medium fee
+func TestSelect(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	carol := newTestWallet(t)
+	chain := newTestChain(t, alice, carol)
+
+	mp := New(chain, DefaultPolicy)
+	parent := newTestTx(t, alice, bob, 5, 0, mp)
+	addTestTx(t, mp, parent)
+	child := newTestTx(t, alice, bob, 5, 10, mp)
+	addTestTx(t, mp, child)
+	other := newTestTx(t, carol, bob, 5, 3, mp)
+	addTestTx(t, mp, other)
+
+	size := func(txs ...*blockchain.Transaction) int {
+		total := 0
+		for _, tx := range txs {
+			total += len(tx.Serialize())
+		}
+		return total
+	}
+
+	tests := []struct {
+		name     string
+		maxBytes int
+		expected []*blockchain.Transaction
+	}{
+		{"no limit", 0, []*blockchain.Transaction{parent, child, other}},
+		{"room for everything", size(parent, child, other), []*blockchain.Transaction{parent, child, other}},
+		{"room for the package", size(parent, child), []*blockchain.Transaction{parent, child}},
+		{"package too big", size(other) + 1, []*blockchain.Transaction{other}},
+		{"room for nothing", size(other) - 1, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected := mp.Select(test.maxBytes)
+			if len(selected) != len(test.expected) {
+				t.Fatalf("Selected %d transactions, expected %d", len(selected), len(test.expected))
+			}
+			total := 0
+			for i, desc := range selected {
+				if !bytes.Equal(desc.Tx.ID, test.expected[i].ID) {
+					t.Fatalf("Transaction %d is %x, expected %x", i, desc.Tx.ID, test.expected[i].ID)
+				}
+				total += desc.Size
+			}
+			if test.maxBytes > 0 && total > test.maxBytes {
+				t.Fatalf("Selected %d bytes, more than %d", total, test.maxBytes)
+			}
+		})
+	}
+}
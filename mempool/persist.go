@@ -0,0 +1,163 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+// Version of the memory pool file, files of other versions are not loaded
+const fileVersion = 1
+
+type savedTx struct {
+	Tx    []byte
+	Added time.Time
+	Fee   int
+}
+
+type savedPool struct {
+	Version int
+	Saved   time.Time
+	Txs     []savedTx
+}
+
+// Summary of the transactions of a memory pool
+type Info struct {
+	Count  int
+	Size   int
+	Fees   int
+	Oldest time.Time // Zero when the pool is empty
+}
+
+func (mp *Mempool) Info() Info {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var descs []*TxDesc
+	for _, desc := range mp.txs {
+		descs = append(descs, desc)
+	}
+
+	return newInfo(descs)
+}
+
+func newInfo(descs []*TxDesc) Info {
+	var info Info
+
+	for _, desc := range descs {
+		info.Count++
+		info.Size += desc.Size
+		info.Fees += desc.Fee
+		if info.Oldest.IsZero() || desc.Added.Before(info.Oldest) {
+			info.Oldest = desc.Added
+		}
+	}
+
+	return info
+}
+
+/*
+	Writes the transactions of the pool to a file, oldest first. The file is written next to the old
+	one and renamed over it, so a node stopped while saving still has the previous file
+*/
+func (mp *Mempool) Save(path string) error {
+	mp.mutex.RLock()
+	saved := savedPool{Version: fileVersion, Saved: time.Now()}
+	for _, desc := range mp.txs {
+		saved.Txs = append(saved.Txs, savedTx{desc.Tx.Serialize(), desc.Added, desc.Fee})
+	}
+	mp.mutex.RUnlock()
+
+	sort.Slice(saved.Txs, func(i, j int) bool {
+		return saved.Txs[i].Added.Before(saved.Txs[j].Added)
+	})
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(saved); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".new"
+	if err := ioutil.WriteFile(tmpPath, content.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func readFile(path string) (savedPool, error) {
+	var saved savedPool
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return saved, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&saved); err != nil {
+		return saved, err
+	}
+	if saved.Version != fileVersion {
+		return saved, fmt.Errorf("Memory pool file version %d is not supported", saved.Version)
+	}
+
+	return saved, nil
+}
+
+/*
+	Adds the transactions saved in a file to the pool. They go through the same checks as the new
+	ones against the current UTXO set, so the ones mined or spent while the node was stopped, and
+	the ones that expired, are dropped. A missing file is an empty pool
+*/
+func (mp *Mempool) Load(path string) (accepted, rejected int, err error) {
+	saved, err := readFile(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	now := time.Now()
+	for _, entry := range saved.Txs {
+		if now.Sub(entry.Added) > mp.policy.Expiry {
+			rejected++
+			continue
+		}
+
+		tx, err := blockchain.DeserializeTransaction(entry.Tx)
+		if err != nil {
+			return accepted, rejected, err
+		}
+
+		if err := mp.add(&tx, entry.Added); err != nil {
+			rejected++
+			continue
+		}
+		accepted++
+	}
+
+	return accepted, rejected, nil
+}
+
+// Reads the summary of a saved memory pool without a chain, the fees are the ones computed when it was saved
+func ReadInfo(path string) (Info, time.Time, error) {
+	saved, err := readFile(path)
+	if err != nil {
+		return Info{}, time.Time{}, err
+	}
+
+	var descs []*TxDesc
+	for _, entry := range saved.Txs {
+		descs = append(descs, &TxDesc{Added: entry.Added, Size: len(entry.Tx), Fee: entry.Fee})
+	}
+
+	return newInfo(descs), saved.Saved, nil
+}
@@ -0,0 +1,89 @@
+package mempool
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		expiry   time.Duration
+		mine     bool // The parent is mined after the pool is saved
+		accepted int
+		rejected int
+	}{
+		{"round trip", DefaultPolicy.Expiry, false, 3, 0},
+		{"parent mined while stopped", DefaultPolicy.Expiry, true, 2, 1},
+		{"expired while stopped", time.Nanosecond, false, 0, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alice := newTestWallet(t)
+			bob := newTestWallet(t)
+			chain := newTestChain(t, alice, bob)
+			policy := DefaultPolicy
+			policy.Expiry = test.expiry
+
+			// The child spends the change of the parent, it must be loaded after it
+			mp := New(chain, DefaultPolicy)
+			parent := newTestTx(t, alice, bob, 5, 1, mp)
+			addTestTx(t, mp, parent)
+			child := newTestTx(t, alice, bob, 5, 2, mp)
+			addTestTx(t, mp, child)
+			other := newTestTx(t, bob, alice, 5, 3, mp)
+			addTestTx(t, mp, other)
+
+			path := filepath.Join(t.TempDir(), "mempool.dat")
+			if err := mp.Save(path); err != nil {
+				t.Fatal(err)
+			}
+			if test.mine {
+				mineTestBlock(t, chain, bob, parent)
+			}
+
+			loaded := New(chain, policy)
+			accepted, rejected, err := loaded.Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted != test.accepted || rejected != test.rejected {
+				t.Fatalf("Loaded %d and rejected %d, expected %d and %d", accepted, rejected, test.accepted, test.rejected)
+			}
+			if accepted == 0 {
+				return
+			}
+
+			for _, desc := range mp.ByFeeRate() {
+				if test.mine && desc.Tx == parent {
+					if loaded.Has(parent.ID) {
+						t.Fatal("The mined parent was loaded")
+					}
+					continue
+				}
+				tx, ok := loaded.Get(desc.Tx.ID)
+				if !ok {
+					t.Fatalf("Transaction %x was not loaded", desc.Tx.ID)
+				}
+				if !bytes.Equal(tx.Serialize(), desc.Tx.Serialize()) {
+					t.Fatalf("Transaction %x changed", desc.Tx.ID)
+				}
+			}
+			// Loaded transactions keep the time they entered the pool, so they expire on time
+			before, after := mp.Info(), loaded.Info()
+			if !test.mine && (before.Count != after.Count || before.Size != after.Size || before.Fees != after.Fees || !after.Oldest.Equal(before.Oldest)) {
+				t.Fatalf("Pool %+v loaded as %+v", before, after)
+			}
+			if ancestors := loaded.Ancestors(child.ID); !test.mine && len(ancestors) != 1 {
+				t.Fatalf("The loaded child has %d ancestors", len(ancestors))
+			}
+		})
+	}
+
+	accepted, rejected, err := New(nil, DefaultPolicy).Load(filepath.Join(t.TempDir(), "missing.dat"))
+	if accepted != 0 || rejected != 0 || err != nil {
+		t.Fatalf("Loading a missing file returned %d, %d, %v", accepted, rejected, err)
+	}
+}
@@ -0,0 +1,70 @@
+package mempool
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+// Limits of the memory pool, they are local to the node and not part of the consensus rules
+type Policy struct {
+	MaxSize        int           // Bytes of serialized transactions kept in the pool
+	Expiry         time.Duration // Transactions not mined after this time are dropped
+	MaxTxSize      int           // Bigger transactions are not standard
+	MaxAncestors   int           // Longest chain of unconfirmed transactions, counting the new one
+	MaxDescendants int           // Most unconfirmed transactions spending the outputs of one, counting itself
+	MaxReplaced    int           // Most transactions a replacement can remove from the pool
+
+	MaxDataCarrierSize int // Bigger data-carrier payloads are not standard, it can't be above the consensus limit
+}
+
+var DefaultPolicy = Policy{
+	MaxSize:        5 << 20,
+	Expiry:         14 * 24 * time.Hour,
+	MaxTxSize:      100000,
+	MaxAncestors:   25,
+	MaxDescendants: 25,
+	MaxReplaced:    100,
+
+	MaxDataCarrierSize: blockchain.MaxDataCarrierSize,
+}
+
+/*
+	Standard transactions are the ones the node relays and mines. A transaction that is valid but
+	not standard can still be in a block mined by someone else
+*/
+func (policy Policy) checkStandard(tx *blockchain.Transaction, size int) error {
+	if size > policy.MaxTxSize {
+		return fmt.Errorf("%w: %d bytes is bigger than %d", ErrNonStandard, size, policy.MaxTxSize)
+	}
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return fmt.Errorf("%w: no inputs or no outputs", ErrNonStandard)
+	}
+
+	dataOutputs := 0
+	for _, out := range tx.Outputs {
+		if out.IsDataCarrier() {
+			dataOutputs++
+			if len(out.Data) > policy.MaxDataCarrierSize {
+				return fmt.Errorf("%w: data-carrier output of %d bytes is bigger than %d", ErrNonStandard, len(out.Data), policy.MaxDataCarrierSize)
+			}
+		} else if out.Value <= 0 {
+			return fmt.Errorf("%w: output without value", ErrNonStandard)
+		}
+	}
+	if dataOutputs > 1 {
+		return fmt.Errorf("%w: more than one data-carrier output", ErrNonStandard)
+	}
+
+	spent := make(map[string]bool)
+	for _, in := range tx.Inputs {
+		key := outpoint(in.ID, in.Out)
+		if spent[key] {
+			return fmt.Errorf("%w: output %s is spent twice", ErrNonStandard, key)
+		}
+		spent[key] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package mempool
+
+import "fmt"
+
+/*
+	A transaction spending an output already spent in the pool replaces the transactions spending
+	it when all of them signal that they are replaceable, it pays more per byte than each of them
+	and more in total than them and their descendants, which are replaced too. It returns the
+	transactions to replace, none when the transaction doesn't conflict with the pool
+*/
+func (mp *Mempool) replacementFor(desc *TxDesc) (map[string]*TxDesc, error) {
+	conflicts := make(map[string]*TxDesc)
+	for _, in := range desc.Tx.Inputs {
+		if spender, ok := mp.spent[outpoint(in.ID, in.Out)]; ok {
+			conflicts[spender] = mp.txs[spender]
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+
+	for txID, conflict := range conflicts {
+		if !conflict.Tx.IsReplaceable() {
+			return nil, fmt.Errorf("%w by %s", ErrConflict, txID)
+		}
+		if !conflict.rate().less(desc.rate()) {
+			return nil, fmt.Errorf("%w: the fee rate is not higher than the one of %s", ErrReplacement, txID)
+		}
+	}
+
+	replaced := walk(conflicts, childrenOf)
+	if len(replaced) > mp.policy.MaxReplaced {
+		return nil, fmt.Errorf("%w: it would replace %d transactions", ErrReplacement, len(replaced))
+	}
+
+	replacedFees := 0
+	for _, member := range replaced {
+		replacedFees += member.Fee
+	}
+	if desc.Fee <= replacedFees {
+		return nil, fmt.Errorf("%w: the fee is not higher than the %d paid by the replaced transactions", ErrReplacement, replacedFees)
+	}
+
+	// The outputs of the replaced transactions are gone with them
+	for parentID := range desc.parents {
+		if _, ok := replaced[parentID]; ok {
+			return nil, fmt.Errorf("%w: it spends an output of %s", ErrReplacement, parentID)
+		}
+	}
+
+	return replaced, nil
+}
@@ -0,0 +1,83 @@
+package mempool
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+func TestReplaceByFee(t *testing.T) {
+	alice := newTestWallet(t)
+	bob := newTestWallet(t)
+	chain := newTestChain(t, alice)
+	confirmed := blockchain.UTXOSet{Blockchain: chain}
+
+	bump := func(fee int) func(*blockchain.Transaction) *blockchain.Transaction {
+		return func(original *blockchain.Transaction) *blockchain.Transaction {
+			tx, err := blockchain.BumpFee(alice, original, fee, confirmed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}
+	}
+
+	tests := []struct {
+		name        string
+		replaceable bool
+		childFee    int // Fee of a child spending the change of the original, none when 0
+		replace     func(original *blockchain.Transaction) *blockchain.Transaction
+		err         error
+	}{
+		{"original not replaceable", false, 0, func(*blockchain.Transaction) *blockchain.Transaction {
+			return newTestTx(t, alice, bob, 6, 5, confirmed)
+		}, ErrConflict},
+		{"same fee rate", true, 0, func(*blockchain.Transaction) *blockchain.Transaction {
+			tx, err := blockchain.NewReplaceableTransaction(alice, address(bob), 6, 2, confirmed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tx
+		}, ErrReplacement},
+		{"higher fee", true, 0, bump(4), nil},
+		{"not paying for the child", true, 5, bump(4), ErrReplacement},
+		{"paying for the child", true, 5, bump(8), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp := New(chain, DefaultPolicy)
+			var original *blockchain.Transaction
+			var err error
+			if test.replaceable {
+				original, err = blockchain.NewReplaceableTransaction(alice, address(bob), 5, 2, mp)
+			} else {
+				original, err = blockchain.NewTransaction(alice, address(bob), 5, 2, mp)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			addTestTx(t, mp, original)
+			kept := []*blockchain.Transaction{original}
+			if test.childFee > 0 {
+				child := newTestTx(t, alice, bob, 5, test.childFee, mp)
+				addTestTx(t, mp, child)
+				kept = append(kept, child)
+			}
+
+			replacement := test.replace(original)
+			if err := mp.Add(replacement); !errors.Is(err, test.err) {
+				t.Fatalf("Add returned %v, expected %v", err, test.err)
+			}
+			if mp.Has(replacement.ID) != (test.err == nil) {
+				t.Fatalf("Replacement in the pool: %t", mp.Has(replacement.ID))
+			}
+			// The descendants of the replaced transaction are replaced with it
+			for _, tx := range kept {
+				if mp.Has(tx.ID) != (test.err != nil) {
+					t.Fatalf("Transaction %x in the pool: %t", tx.ID, mp.Has(tx.ID))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"sort"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+/*
+	The pool is a blockchain.UTXOView: the outputs of its transactions can be spent before they are
+	mined and the outputs they already spend are hidden, so a wallet can spend its unconfirmed change
+*/
+
+// Confirmed outputs are used first, the unconfirmed ones only when they are not enough
+func (mp *Mempool) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	confirmed, err := blockchain.UTXOSet{Blockchain: mp.chain}.FindUnspentOutputs(pubKeyHash)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	unspentOuts := make(map[string][]int)
+	accumulated := 0
+
+	spend := func(txID []byte, outs blockchain.TxOutputs) {
+		for i, out := range outs.Outputs {
+			if accumulated >= amount {
+				return
+			}
+			if _, ok := mp.spent[outpoint(txID, outs.Index(i))]; ok {
+				continue
+			}
+			accumulated += out.Value
+			key := hex.EncodeToString(txID)
+			unspentOuts[key] = append(unspentOuts[key], outs.Index(i))
+		}
+	}
+
+	for _, key := range sortedKeys(confirmed) {
+		txID, err := hex.DecodeString(key)
+		if err != nil {
+			return 0, nil, err
+		}
+		spend(txID, confirmed[key])
+	}
+
+	for _, desc := range toList(mp.unconfirmedOutputs(pubKeyHash)) {
+		outs := blockchain.TxOutputs{}
+		for index, out := range desc.Tx.Outputs {
+			if !out.IsDataCarrier() && out.IsLockedWithKey(pubKeyHash) {
+				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, index)
+			}
+		}
+		spend(desc.Tx.ID, outs)
+	}
+
+	return accumulated, unspentOuts, nil
+}
+
+// The transactions of the pool with outputs locked with the key
+func (mp *Mempool) unconfirmedOutputs(pubKeyHash []byte) map[string]*TxDesc {
+	owned := make(map[string]*TxDesc)
+
+	for txID, desc := range mp.txs {
+		for _, out := range desc.Tx.Outputs {
+			if !out.IsDataCarrier() && out.IsLockedWithKey(pubKeyHash) {
+				owned[txID] = desc
+				break
+			}
+		}
+	}
+
+	return owned
+}
+
+// The previous transactions still in the pool are taken from it and the rest from the chain
+func (mp *Mempool) GetPreviousTransactions(tx *blockchain.Transaction) (map[string]blockchain.Transaction, error) {
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	prevTxs := make(map[string]blockchain.Transaction)
+
+	for _, in := range tx.Inputs {
+		inID := hex.EncodeToString(in.ID)
+		if parent, ok := mp.txs[inID]; ok {
+			prevTxs[inID] = *parent.Tx
+			continue
+		}
+
+		prevTx, err := mp.chain.FindPreviousTransaction(in.ID)
+		if err != nil {
+			return nil, err
+		}
+		prevTxs[inID] = prevTx
+	}
+
+	return prevTxs, nil
+}
+
+func sortedKeys(outputs map[string]blockchain.TxOutputs) []string {
+	var keys []string
+	for key := range outputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,114 @@
+package mining
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+// Connection of an external miner to the work server of a node
+type WorkClient struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	encoder *json.Encoder
+	nextID  int
+}
+
+func DialWork(address string) (*WorkClient, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WorkClient{conn: conn, scanner: bufio.NewScanner(conn), encoder: json.NewEncoder(conn)}, nil
+}
+
+func (client *WorkClient) Close() error {
+	return client.conn.Close()
+}
+
+// Sends a request and waits for its answer, the protocol has one request in flight at a time
+func (client *WorkClient) call(method string, params, result interface{}) error {
+	client.nextID++
+	req := request{ID: client.nextID, Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+
+	if err := client.encoder.Encode(req); err != nil {
+		return err
+	}
+
+	if !client.scanner.Scan() {
+		if err := client.scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("The node closed the connection")
+	}
+
+	var resp response
+	if err := json.Unmarshal(client.scanner.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	return json.Unmarshal(resp.Result, result)
+}
+
+func (client *WorkClient) GetWork() (*Work, error) {
+	var work Work
+	if err := client.call("getwork", nil, &work); err != nil {
+		return nil, err
+	}
+
+	return &work, nil
+}
+
+func (client *WorkClient) SubmitBlock(jobID string, nonce int64) (*SubmitResult, error) {
+	var result SubmitResult
+	if err := client.call("submitblock", Submission{jobID, nonce}, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+/*
+	Tries the nonces from start to start+count-1 and returns the first one whose hash meets the
+	target of the work. A miner tries a range at a time so it can ask for new work between them
+*/
+func Solve(work *Work, start, count int64) (int64, bool, error) {
+	prefix, err := hex.DecodeString(work.Header)
+	if err != nil {
+		return 0, false, err
+	}
+	targetBytes, err := hex.DecodeString(work.Target)
+	if err != nil {
+		return 0, false, err
+	}
+	target := new(big.Int).SetBytes(targetBytes)
+
+	var intHash big.Int
+	for nonce := start; nonce < start+count; nonce++ {
+		hash := sha256.Sum256(blockchain.PowData(prefix, nonce, work.Difficulty))
+		intHash.SetBytes(hash[:])
+
+		if intHash.Cmp(target) == -1 {
+			return nonce, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,60 @@
+package mining
+
+import (
+	"github.com/blockchain-app-go/blockchain"
+	"github.com/blockchain-app-go/mempool"
+)
+
+const (
+	DefaultMaxBlockSize = 1 << 20
+	reservedSize        = 1000 // Bytes of the block kept for its header and its coinbase
+)
+
+/*
+	A block template is what a miner needs to mine the next block: the block it goes on top of,
+	the coinbase and the transactions of the memory pool that pay the most per byte and fit in
+	the block, ordered so every transaction goes after the ones whose outputs it spends
+*/
+type BlockTemplate struct {
+	PrevHash     []byte
+	Height       int
+	Coinbase     *blockchain.Transaction // Pays the subsidy and the fees of the transactions to the miner
+	Transactions []*mempool.TxDesc
+	Fees         int
+	Size         int // Bytes of the transactions, without the header and the coinbase
+}
+
+func NewBlockTemplate(chain *blockchain.Blockchain, pool *mempool.Mempool, minerAddress string, maxSize int) (*BlockTemplate, error) {
+	prevHash := chain.LastHash()
+	prevBlock, err := chain.GetBlock(prevHash)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &BlockTemplate{PrevHash: prevHash, Height: prevBlock.Height + 1}
+	// Select takes 0 as no limit, a block too small for anything but its coinbase gets no transactions
+	if maxSize > reservedSize {
+		template.Transactions = pool.Select(maxSize - reservedSize)
+	}
+	for _, desc := range template.Transactions {
+		template.Fees += desc.Fee
+		template.Size += desc.Size
+	}
+
+	template.Coinbase, err = blockchain.CoinbaseTxWithFees(minerAddress, "", template.Fees)
+	if err != nil {
+		return nil, err
+	}
+
+	return template, nil
+}
+
+// The transactions of the block, the coinbase first
+func (template *BlockTemplate) BlockTransactions() []*blockchain.Transaction {
+	txs := []*blockchain.Transaction{template.Coinbase}
+	for _, desc := range template.Transactions {
+		txs = append(txs, desc.Tx)
+	}
+
+	return txs
+}
@@ -0,0 +1,85 @@
+package mining
+
+import (
+	"fmt"
+	"time"
+)
+
+// What makes a miner start a new block
+type Trigger int
+
+const (
+	TriggerCount      Trigger = iota // The memory pool has at least MinTxs transactions
+	TriggerInterval                  // Every Interval, the block is empty when there are no transactions
+	TriggerContinuous                // One block after the other, empty when there are no transactions
+	TriggerNone                      // Never, the blocks are mined by external miners through the work protocol
+)
+
+var triggerNames = map[Trigger]string{
+	TriggerCount:      "count",
+	TriggerInterval:   "interval",
+	TriggerContinuous: "continuous",
+	TriggerNone:       "none",
+}
+
+func (trigger Trigger) String() string {
+	if name, ok := triggerNames[trigger]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Trigger(%d)", int(trigger))
+}
+
+func ParseTrigger(name string) (Trigger, error) {
+	for trigger, triggerName := range triggerNames {
+		if triggerName == name {
+			return trigger, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown mining trigger %q, use count, interval, continuous or none", name)
+}
+
+// When a node mines its blocks, it is local to the node like the limits of its memory pool
+type TriggerPolicy struct {
+	Trigger  Trigger
+	MinTxs   int           // Transactions waiting in the memory pool before a block is mined by TriggerCount
+	Interval time.Duration // Time between the blocks mined by TriggerInterval
+}
+
+var DefaultTriggerPolicy = TriggerPolicy{
+	Trigger:  TriggerCount,
+	MinTxs:   1,
+	Interval: time.Minute,
+}
+
+func (policy TriggerPolicy) Validate() error {
+	switch policy.Trigger {
+	case TriggerCount:
+		if policy.MinTxs < 1 {
+			return fmt.Errorf("The count trigger needs at least 1 transaction, got %d", policy.MinTxs)
+		}
+	case TriggerInterval:
+		if policy.Interval <= 0 {
+			return fmt.Errorf("The interval trigger needs a positive interval, got %s", policy.Interval)
+		}
+	case TriggerContinuous, TriggerNone:
+	default:
+		return fmt.Errorf("Unknown mining trigger %s", policy.Trigger)
+	}
+
+	return nil
+}
+
+func (policy TriggerPolicy) String() string {
+	switch policy.Trigger {
+	case TriggerCount:
+		return fmt.Sprintf("mine when %d transactions are waiting", policy.MinTxs)
+	case TriggerInterval:
+		return fmt.Sprintf("mine every %s", policy.Interval)
+	case TriggerNone:
+		return "leave mining to external miners"
+	default:
+		return "mine continuously"
+	}
+}
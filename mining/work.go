@@ -0,0 +1,235 @@
+package mining
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/blockchain-app-go/blockchain"
+	"github.com/blockchain-app-go/mempool"
+)
+
+/*
+	The work protocol lets miners outside the node do the proof of work. It is a line of JSON per
+	message over a TCP connection that stays open: the miner sends a request with an id, a method
+	and its params, and the node answers with the same id and a result or an error.
+
+		getwork      gives a Work, the header of a block the node prepared and the target to beat
+		submitblock  takes a Submission, the nonce found for a job, and gives a SubmitResult
+
+	The node keeps the blocks it gave out as jobs until the tip of the chain moves, so a miner
+	sends back only the job ID and the nonce
+*/
+
+const maxJobs = 64 // Jobs kept for the current tip, the oldest are forgotten first
+
+var (
+	ErrUnknownJob    = errors.New("Unknown or stale job")
+	ErrUnknownMethod = errors.New("Unknown method")
+)
+
+// A block to mine, the hash of PowData(Header, nonce, Difficulty) must be lower than Target
+type Work struct {
+	JobID        string `json:"job_id"`
+	Height       int    `json:"height"`
+	PrevHash     string `json:"prev_hash"`
+	Header       string `json:"header"` // Hex of the data hashed before the nonce
+	Difficulty   int    `json:"difficulty"`
+	Target       string `json:"target"` // Hex of the target
+	Transactions int    `json:"transactions"`
+	Fees         int    `json:"fees"`
+}
+
+type Submission struct {
+	JobID string `json:"job_id"`
+	Nonce int64  `json:"nonce"`
+}
+
+type SubmitResult struct {
+	Hash   string `json:"hash"`
+	Height int    `json:"height"`
+}
+
+type request struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type job struct {
+	id       string
+	block    *blockchain.Block // Without its nonce and hash yet
+	template *BlockTemplate
+}
+
+// Gives work to the external miners and connects the blocks they find
+type WorkServer struct {
+	chain        *blockchain.Blockchain
+	pool         *mempool.Mempool
+	minerAddress string
+	maxSize      int
+	onBlock      func(*blockchain.Block) // Called with every block found, after it is connected
+
+	mutex   sync.Mutex
+	jobs    map[string]*job
+	order   []string // Job IDs, oldest first
+	counter int
+}
+
+func NewWorkServer(chain *blockchain.Blockchain, pool *mempool.Mempool, minerAddress string, maxSize int, onBlock func(*blockchain.Block)) *WorkServer {
+	return &WorkServer{
+		chain:        chain,
+		pool:         pool,
+		minerAddress: minerAddress,
+		maxSize:      maxSize,
+		onBlock:      onBlock,
+		jobs:         make(map[string]*job),
+	}
+}
+
+// Prepares a new block with the best transactions of the pool, the jobs of an older tip are dropped
+func (server *WorkServer) GetWork() (*Work, error) {
+	template, err := NewBlockTemplate(server.chain, server.pool, server.minerAddress, server.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := server.chain.PrepareBlock(template.BlockTransactions())
+	if err != nil {
+		return nil, err
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for _, old := range server.jobs {
+		if !bytes.Equal(old.block.PrevHash, block.PrevHash) {
+			server.forget(old.id)
+		}
+	}
+	if len(server.order) >= maxJobs {
+		server.forget(server.order[0])
+	}
+
+	server.counter++
+	current := &job{fmt.Sprintf("%x", server.counter), block, template}
+	server.jobs[current.id] = current
+	server.order = append(server.order, current.id)
+
+	pow := blockchain.NewProof(block)
+
+	return &Work{
+		JobID:        current.id,
+		Height:       block.Height,
+		PrevHash:     hex.EncodeToString(block.PrevHash),
+		Header:       hex.EncodeToString(pow.HeaderPrefix()),
+		Difficulty:   blockchain.Difficulty,
+		Target:       hex.EncodeToString(pow.Target.Bytes()),
+		Transactions: len(template.Transactions),
+		Fees:         template.Fees,
+	}, nil
+}
+
+func (server *WorkServer) forget(jobID string) {
+	delete(server.jobs, jobID)
+	for i, id := range server.order {
+		if id == jobID {
+			server.order = append(server.order[:i], server.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Connects the block of the job with the nonce, a job is done once one of its blocks is connected
+func (server *WorkServer) SubmitBlock(submission Submission) (*SubmitResult, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	current, ok := server.jobs[submission.JobID]
+	if !ok {
+		return nil, ErrUnknownJob
+	}
+
+	block, err := server.chain.SubmitBlock(current.block, int(submission.Nonce))
+	if errors.Is(err, blockchain.ErrStaleTip) {
+		server.forget(current.id)
+		return nil, ErrUnknownJob
+	} else if err != nil {
+		return nil, err
+	}
+	server.forget(current.id)
+
+	fmt.Printf("New Block found by an external miner with %d transactions paying %d in fees\n", len(current.template.Transactions), current.template.Fees)
+
+	server.pool.RemoveBlock(block)
+	if server.onBlock != nil {
+		server.onBlock(block)
+	}
+
+	return &SubmitResult{hex.EncodeToString(block.Hash), block.Height}, nil
+}
+
+// Answers the miners connected to the listener until it is closed
+func (server *WorkServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go server.handle(conn)
+	}
+}
+
+// A request that can't be answered gets an error, only a broken connection ends it
+func (server *WorkServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req request
+		var result interface{}
+		var err error
+
+		if err = json.Unmarshal(scanner.Bytes(), &req); err == nil {
+			result, err = server.call(req)
+		}
+
+		resp := response{ID: req.ID}
+		if err != nil {
+			resp.Error = err.Error()
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Error = err.Error()
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (server *WorkServer) call(req request) (interface{}, error) {
+	switch req.Method {
+	case "getwork":
+		return server.GetWork()
+	case "submitblock":
+		var submission Submission
+		if err := json.Unmarshal(req.Params, &submission); err != nil {
+			return nil, err
+		}
+		return server.SubmitBlock(submission)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownMethod, req.Method)
+	}
+}
@@ -0,0 +1,179 @@
+package mining
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/blockchain-app-go/blockchain"
+	"github.com/blockchain-app-go/mempool"
+	"github.com/blockchain-app-go/storage"
+	"github.com/blockchain-app-go/wallet"
+)
+
+func newTestWallet(t *testing.T) *wallet.Wallet {
+	t.Helper()
+
+	w, err := wallet.MakeWallet(wallet.P256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+// A work server on a chain whose genesis pays alice, with a transaction of alice waiting in the pool
+func newTestServer(t *testing.T, onBlock func(*blockchain.Block)) (*WorkServer, *blockchain.Transaction) {
+	t.Helper()
+
+	alice := newTestWallet(t)
+	chain, err := blockchain.InitBlockchainInStore(string(alice.Address()), storage.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := mempool.New(chain, mempool.DefaultPolicy)
+	tx, err := blockchain.NewTransaction(alice, string(newTestWallet(t).Address()), 5, 1, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewWorkServer(chain, pool, string(alice.Address()), DefaultMaxBlockSize, onBlock), tx
+}
+
+func solveTestWork(t *testing.T, work *Work) int64 {
+	t.Helper()
+
+	nonce, found, err := Solve(work, 0, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("No nonce meets the target")
+	}
+
+	return nonce
+}
+
+// A miner connected to the node gets work, solves it and the block with the pool transaction is connected
+func TestWorkRoundTrip(t *testing.T) {
+	// The blocks are found on the goroutine of the connection
+	found := make(chan *blockchain.Block, 1)
+	server, tx := newTestServer(t, func(block *blockchain.Block) {
+		found <- block
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+
+	client, err := DialWork(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	work, err := client.GetWork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.Height != 1 || work.Transactions != 1 || work.Fees != 1 {
+		t.Fatalf("Work for height %d with %d transactions paying %d", work.Height, work.Transactions, work.Fees)
+	}
+
+	result, err := client.SubmitBlock(work.JobID, solveTestWork(t, work))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := server.chain.GetBlock(server.chain.LastHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Height != 1 || result.Hash != hex.EncodeToString(block.Hash) {
+		t.Fatalf("Block %s at height %d submitted, the tip is %x", result.Hash, result.Height, block.Hash)
+	}
+	if len(block.Transactions) != 2 || !bytes.Equal(block.Transactions[1].ID, tx.ID) {
+		t.Fatal("The block doesn't have the transaction of the pool")
+	}
+	if server.pool.Has(tx.ID) {
+		t.Fatal("The mined transaction is still in the pool")
+	}
+	select {
+	case told := <-found:
+		if !bytes.Equal(told.Hash, block.Hash) {
+			t.Fatalf("The node was told about block %x", told.Hash)
+		}
+	default:
+		t.Fatal("The node was not told about the block")
+	}
+
+	// The job is done, its block can't be sent twice
+	if _, err := client.SubmitBlock(work.JobID, 0); err == nil || !strings.Contains(err.Error(), ErrUnknownJob.Error()) {
+		t.Fatalf("Submitting the job again returned %v", err)
+	}
+}
+
+func TestSubmitBlockRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		submit func(t *testing.T, server *WorkServer) error
+		err    error
+		blocks int // Connected by the submissions before the rejected one
+	}{
+		{"unknown job", func(t *testing.T, server *WorkServer) error {
+			_, err := server.SubmitBlock(Submission{"unknown", 0})
+			return err
+		}, ErrUnknownJob, 0},
+		{"nonce missing the target", func(t *testing.T, server *WorkServer) error {
+			work, err := server.GetWork()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce := int64(0)
+			for {
+				if _, found, _ := Solve(work, nonce, 1); !found {
+					break
+				}
+				nonce++
+			}
+			_, err = server.SubmitBlock(Submission{work.JobID, nonce})
+			return err
+		}, blockchain.ErrInvalidProof, 0},
+		{"stale job", func(t *testing.T, server *WorkServer) error {
+			stale, err := server.GetWork()
+			if err != nil {
+				t.Fatal(err)
+			}
+			work, err := server.GetWork()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := server.SubmitBlock(Submission{work.JobID, solveTestWork(t, work)}); err != nil {
+				t.Fatal(err)
+			}
+			// Its block goes on the old tip
+			_, err = server.SubmitBlock(Submission{stale.JobID, solveTestWork(t, stale)})
+			return err
+		}, ErrUnknownJob, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := newTestServer(t, nil)
+
+			if err := test.submit(t, server); !errors.Is(err, test.err) {
+				t.Fatalf("SubmitBlock returned %v, expected %v", err, test.err)
+			}
+			if height, err := server.chain.GetBestHeight(); err != nil || height != test.blocks {
+				t.Fatalf("The chain is at height %d, expected %d", height, test.blocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+
+	"github.com/blockchain-app-go/datadir"
+	"github.com/blockchain-app-go/mining"
+	"github.com/blockchain-app-go/wallet"
+)
+
+/*
+	The commands that drive the running node, like pausing its miner, don't go over the peer to peer
+	network, where any peer that completed the handshake could send them. The node listens for them
+	on a unix socket in its directory, so only the users of the machine allowed into that directory
+	can use them. It is a line of JSON per message like the work protocol: a request with a method
+	and its params, and the answer with a result or an error.
+
+		setmining         takes a SetMining, pauses or resumes the miner
+		savemempool       saves the memory pool and the fee estimates to disk
+		getblocktemplate  takes a TemplateRequest and gives the TemplateInfo of the block the node
+		                  would mine with its memory pool right now
+*/
+
+const controlProtocol = "unix"
+
+var ErrUnknownControl = errors.New("Unknown control method")
+
+// Pauses or resumes the miner of the node, it is sent by the pausemining and resumemining commands
+type SetMining struct {
+	Active bool `json:"active"`
+}
+
+type TemplateRequest struct {
+	Miner   string `json:"miner"` // Address receiving the coinbase
+	MaxSize int    `json:"max_size"`
+}
+
+// A block template without the transactions themselves, they stay in the memory pool of the node
+type TemplateInfo struct {
+	Height       int          `json:"height"`
+	PrevHash     string       `json:"prev_hash"`
+	Reward       int          `json:"reward"` // Paid by the coinbase, the subsidy and the fees
+	Size         int          `json:"size"`
+	Fees         int          `json:"fees"`
+	Transactions []TemplateTx `json:"transactions"`
+}
+
+type TemplateTx struct {
+	ID      string  `json:"id"`
+	Fee     int     `json:"fee"`
+	Size    int     `json:"size"`
+	FeeRate float64 `json:"fee_rate"`
+}
+
+type controlRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type controlResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+/*
+	Listens on the control socket of the node. A socket left by a node that didn't stop cleanly is
+	removed first, the lock of the blocks database already keeps two nodes from sharing a directory
+*/
+func listenControl(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return net.Listen(controlProtocol, path)
+}
+
+// Answers the commands connected to the listener until it is closed
+func serveControl(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handleControl(conn)
+	}
+}
+
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req controlRequest
+		var result interface{}
+		var err error
+
+		if err = json.Unmarshal(scanner.Bytes(), &req); err == nil {
+			result, err = callControl(req)
+		}
+
+		var resp controlResponse
+		if err != nil {
+			resp.Error = err.Error()
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Error = err.Error()
+		}
+
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func callControl(req controlRequest) (interface{}, error) {
+	switch req.Method {
+	case "setmining":
+		var params SetMining
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		setMining(params.Active)
+		return nil, nil
+	case "savemempool":
+		return nil, saveMempool()
+	case "getblocktemplate":
+		var params TemplateRequest
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return blockTemplate(params)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownControl, req.Method)
+	}
+}
+
+// Sends a request to the control socket of the running node and decodes its result into result
+func controlCall(nodeID, method string, params, result interface{}) error {
+	conn, err := net.DialTimeout(controlProtocol, datadir.ControlSocket(nodeID), dialTimeout)
+	if err != nil {
+		return fmt.Errorf("Node %s is not running: %w", nodeID, err)
+	}
+	defer conn.Close()
+
+	req := controlRequest{Method: method}
+	if params != nil {
+		if req.Params, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	var resp controlResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Result, result)
+}
+
+func SendSaveMempool(nodeID string) error {
+	return controlCall(nodeID, "savemempool", nil, nil)
+}
+
+func SendSetMining(nodeID string, active bool) error {
+	return controlCall(nodeID, "setmining", SetMining{active}, nil)
+}
+
+func GetBlockTemplate(nodeID, minerAddress string, maxSize int) (*TemplateInfo, error) {
+	var info TemplateInfo
+	if err := controlCall(nodeID, "getblocktemplate", TemplateRequest{minerAddress, maxSize}, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func blockTemplate(params TemplateRequest) (*TemplateInfo, error) {
+	if !wallet.ValidateAddress(params.Miner) {
+		return nil, errors.New("Address is not Valid")
+	}
+	if params.MaxSize <= 0 {
+		return nil, errors.New("Maximum block size must be positive")
+	}
+
+	template, err := mining.NewBlockTemplate(nodeChain, pool, params.Miner, params.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TemplateInfo{
+		Height:   template.Height,
+		PrevHash: hex.EncodeToString(template.PrevHash),
+		Reward:   template.Coinbase.OutputValue(),
+		Size:     template.Size,
+		Fees:     template.Fees,
+	}
+	for _, desc := range template.Transactions {
+		info.Transactions = append(info.Transactions, TemplateTx{hex.EncodeToString(desc.Tx.ID), desc.Fee, desc.Size, desc.FeeRate()})
+	}
+
+	return info, nil
+}
+
+func setMining(active bool) {
+	if active {
+		atomic.StoreInt32(&miningPaused, 0)
+		fmt.Println("Mining resumed")
+		notifyMiner()
+	} else {
+		atomic.StoreInt32(&miningPaused, 1)
+		fmt.Println("Mining paused, the block being mined is finished first")
+	}
+}
@@ -0,0 +1,233 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+	Two peers exchange a version message and answer the other's one with a verack before anything
+	else. The side that dials sends its version first, the other side answers with its own version
+	and a verack, and the handshake is complete for each side once it got both. A peer speaking an
+	older protocol is refused, and a peer sending any other message before the handshake completes,
+	or a second version, is disconnected. So is an inbound peer claiming to listen on another host
+*/
+
+const (
+	minProtocolVersion = 2 // Oldest protocol the node talks to, older nodes can't read framed messages
+	userAgent          = "/blockchain-app-go:2/"
+	handshakeTimeout   = 10 * time.Second
+)
+
+// Services a peer offers, announced in its version message
+type ServiceFlags uint64
+
+const (
+	ServiceFullNode ServiceFlags = 1 << iota // Keeps and serves every block
+	ServicePruned                            // Keeps only the last blocks, older ones are answered with notfound
+	ServiceSPV                               // Serves headers to light clients
+	ServiceMiner                             // Mines blocks
+)
+
+var serviceNames = []struct {
+	flag ServiceFlags
+	name string
+}{
+	{ServiceFullNode, "full"},
+	{ServicePruned, "pruned"},
+	{ServiceSPV, "spv"},
+	{ServiceMiner, "miner"},
+}
+
+func (services ServiceFlags) Has(flag ServiceFlags) bool {
+	return services&flag == flag
+}
+
+func (services ServiceFlags) String() string {
+	var names []string
+	for _, service := range serviceNames {
+		if services.Has(service.flag) {
+			names = append(names, service.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, "|")
+}
+
+var (
+	errOldProtocol = errors.New("Peer speaks an older protocol")
+	errNoHandshake = errors.New("Peer sent a message before the handshake")
+	errRepeated    = errors.New("Peer sent its version or verack twice")
+	errWrongHost   = errors.New("Peer claims to listen on another host")
+)
+
+func (p *peer) listenAddress() string {
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+
+	return p.address
+}
+
+// What the node offers, the commands that only send messages offer nothing
+func localServices() ServiceFlags {
+	if nodeChain == nil {
+		return 0
+	}
+
+	services := ServiceSPV
+	if PruneDepth > 0 {
+		services |= ServicePruned
+	} else {
+		services |= ServiceFullNode
+	}
+	if len(mineAddress) > 0 {
+		services |= ServiceMiner
+	}
+
+	return services
+}
+
+func (p *peer) sendVersion() error {
+	bestHeight := 0
+	if nodeChain != nil {
+		height, err := nodeChain.GetBestHeight()
+		if err != nil {
+			return err
+		}
+		bestHeight = height
+	}
+
+	payload := GobEncode(Version{version, bestHeight, nodeAddress, localServices(), userAgent, time.Now().Unix()})
+
+	return p.send(append(CmdToBytes("version"), payload...))
+}
+
+func (p *peer) handleVersion(request []byte) error {
+	if p.version != nil {
+		return errRepeated
+	}
+
+	var payload Version
+	if err := gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(&payload); err != nil {
+		return err
+	}
+	if payload.Version < minProtocolVersion {
+		return fmt.Errorf("%w: version %d, the oldest supported is %d", errOldProtocol, payload.Version, minProtocolVersion)
+	}
+	p.version = &payload
+	if !p.outbound {
+		if payload.AddrFrom != "" && !listensOnHost(payload.AddrFrom, p.conn.RemoteAddr()) {
+			return fmt.Errorf("%w: %s connects from %s", errWrongHost, payload.AddrFrom, p.conn.RemoteAddr())
+		}
+		peersMutex.Lock()
+		p.address = payload.AddrFrom
+		peersMutex.Unlock()
+		if err := p.sendVersion(); err != nil {
+			return err
+		}
+	}
+
+	if err := p.send(append(CmdToBytes("verack"), GobEncode(Verack{nodeAddress})...)); err != nil {
+		return err
+	}
+
+	return p.checkHandshake()
+}
+
+/*
+	An inbound peer is registered by the address it says it listens on, so that address must be on
+	the host it connects from. Otherwise any peer could take the place of another node and get the
+	messages sent to it
+*/
+func listensOnHost(address string, remote net.Addr) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remoteHost)
+	if remoteIP == nil {
+		return false
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(remoteIP) || (ip.IsLoopback() && remoteIP.IsLoopback()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *peer) handleVerack() error {
+	if p.verack {
+		return errRepeated
+	}
+	p.verack = true
+
+	return p.checkHandshake()
+}
+
+/*
+	Once both messages arrived the peer is registered by the address it listens on, so the messages
+	for it go over this connection, and the node asks it for its headers when it is missing blocks
+*/
+func (p *peer) checkHandshake() error {
+	if p.version == nil || !p.verack {
+		return nil
+	}
+
+	if err := p.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	address := p.listenAddress()
+	if address != "" {
+		peersMutex.Lock()
+		if _, ok := peers[address]; !ok {
+			peers[address] = p
+		}
+		peersMutex.Unlock()
+	}
+	close(p.ready)
+
+	fmt.Printf("Connected to %s %s version %d, services %s, height %d\n", p.describe(), p.version.UserAgent, p.version.Version, p.version.Services, p.version.BestHeight)
+
+	if nodeChain == nil || address == "" {
+		return nil
+	}
+
+	bestHeight, err := nodeChain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if bestHeight < p.version.BestHeight {
+		SendGetHeaders(address)
+	}
+	addKnownNodes(address)
+
+	return nil
+}
+
+// The address the peer listens on, or the one it connects from for the commands that don't listen
+func (p *peer) describe() string {
+	if address := p.listenAddress(); address != "" {
+		return address
+	}
+
+	return p.conn.RemoteAddr().String()
+}
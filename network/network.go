@@ -3,32 +3,50 @@ package network
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/blockchain-app-go/blockchain"
+	"github.com/blockchain-app-go/datadir"
+	"github.com/blockchain-app-go/mempool"
+	"github.com/blockchain-app-go/mining"
+	"github.com/blockchain-app-go/storage"
 	"github.com/vrecan/death/v3"
 )
 
 const (
 	protocol      = "tcp"
-	version       = 1
+	version       = 2 // Messages are framed since version 2, older nodes can't read them
 	commandLength = 12
+
+	mempoolSaveInterval = 10 * time.Minute // The memory pool is also saved when the node stops
 )
 
 var (
-	nodeAddress     string                                    // node port that will be open
-	mineAddress     string                                    // Node address of the node that is acting as a miner for the network
-	KnownNodes      = []string{"localhost:3000"}              //main node
-	blocksInTransit = [][]byte{}                              // Blocks sent from one client to the next
-	memoryPool      = make(map[string]blockchain.Transaction) // Blockchain transaction store
+	nodeAddress     string                        // node port that will be open
+	mineAddress     string                        // Node address of the node that is acting as a miner for the network
+	KnownNodes      = []string{"localhost:3000"}  //main node, guarded by nodesMutex once the server runs
+	blocksInTransit = [][]byte{}                  // Blocks sent from one client to the next, guarded by transitMutex
+	pool            *mempool.Mempool              // Transactions waiting to be mined, created when the server starts
+	mempoolFile     string                        // File where the memory pool is saved
+	feesFile        string                        // File where the fee estimates are saved with the memory pool
+	controlFile     string                        // Socket the commands drive the node through, removed when it stops
+	PruneDepth      = 0                           // Number of full blocks kept by a pruned node, 0 keeps all of them
+	MempoolPolicy   = mempool.DefaultPolicy       // Limits of the memory pool of the node
+	MaxBlockSize    = mining.DefaultMaxBlockSize  // Bytes of the blocks mined by the node
+	MiningPolicy    = mining.DefaultTriggerPolicy // When the node mines its blocks
+	mineSignal      = make(chan struct{}, 1)      // Wakes the miner up when the pool changes or mining resumes
+	miningPaused    int32                         // Set to 1 by a setmining command, read and written atomically
+	WorkAddress     string                        // Address where external miners ask for work, empty disables it
+	Regtest         bool                          // Runs the node on the regtest chain in memory, only the control socket goes to disk
 )
 
 // STRUCTURES USED TO IDENTIFY THE TYPE OF DATA //
@@ -54,6 +72,23 @@ type GetData struct {
 	ID       []byte
 }
 
+type GetHeaders struct {
+	AddrFrom string
+}
+
+// Serialized blocks without transactions ordered from the genesis to the tip
+type Headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
+// Answer to a getdata asking for something the node doesn't have, like a pruned block
+type NotFound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
 type Inventory struct {
 	AddrFrom string
 	Type     string
@@ -65,10 +100,18 @@ type Tx struct {
 	Transaction []byte
 }
 
+// First message sent to a peer, it must be answered with a verack before anything else
 type Version struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	Services   ServiceFlags
+	UserAgent  string
+	Timestamp  int64 // Unix time of the peer when it sent the message
+}
+
+type Verack struct {
+	AddrFrom string
 }
 
 func CmdToBytes(cmd string) []byte {
@@ -98,13 +141,13 @@ func ExtractCmd(request []byte) []byte {
 }
 
 func RequestBlocks() {
-	for _, node := range KnownNodes {
+	for _, node := range knownNodes() {
 		SendGetBlocks(node)
 	}
 }
 
 func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
+	nodes := Addr{knownNodes()}
 	nodes.AddrList = append(nodes.AddrList, nodeAddress)
 	payload := GobEncode(nodes)
 	request := append(CmdToBytes("addr"), payload...)
@@ -120,30 +163,28 @@ func SendBlock(addr string, b *blockchain.Block) {
 	SendData(addr, request)
 }
 
+/*
+	Sends the request over the connection open to the peer, or a new one. A connection that fails
+	may be to a peer that restarted, so the request is tried once more on a fresh connection
+*/
 func SendData(addr string, data []byte) {
-	fmt.Printf("Address: ", addr)
-	conn, err := net.Dial(protocol, addr)
+	fmt.Printf("Address: %s\n", addr)
 
-	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
+	for attempt := 0; attempt < 2; attempt++ {
+		p, err := connectPeer(addr)
+		if err != nil {
+			fmt.Printf("%s is not available\n", addr)
+			removeKnownNode(addr)
 
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
+			return
 		}
 
-		KnownNodes = updatedNodes
-
-		return
-	}
-
-	defer conn.Close()
-
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+		err = p.send(data)
+		if err == nil {
+			return
+		}
+		fmt.Printf("Failed to send data to %s: %s\n", addr, err)
+		p.close()
 	}
 }
 
@@ -169,303 +210,726 @@ func SendGetData(address, kind string, id []byte) {
 	SendData(address, request)
 }
 
-func SendTx(addr string, tnx *blockchain.Transaction) {
-	data := Tx{nodeAddress, tnx.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("tx"), payload...)
+func SendGetHeaders(address string) {
+	payload := GobEncode(GetHeaders{nodeAddress})
+	request := append(CmdToBytes("getheaders"), payload...)
 
-	SendData(addr, request)
+	SendData(address, request)
+}
+
+func SendHeaders(address string, headers []*blockchain.Block) {
+	var data [][]byte
+	for _, header := range headers {
+		data = append(data, header.Serialize())
+	}
+
+	payload := GobEncode(Headers{nodeAddress, data})
+	request := append(CmdToBytes("headers"), payload...)
+
+	SendData(address, request)
 }
 
-func SendVersion(addr string, chain *blockchain.Blockchain) {
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+func SendNotFound(address, kind string, id []byte) {
+	payload := GobEncode(NotFound{nodeAddress, kind, id})
+	request := append(CmdToBytes("notfound"), payload...)
 
-	request := append(CmdToBytes("version"), payload...)
+	SendData(address, request)
+}
+
+func SendTx(addr string, tnx *blockchain.Transaction) {
+	data := Tx{nodeAddress, tnx.Serialize()}
+	payload := GobEncode(data)
+	request := append(CmdToBytes("tx"), payload...)
 
 	SendData(addr, request)
 }
 
-func HandleAddr(request []byte) {
+func HandleAddr(request []byte) error {
 	var buff bytes.Buffer
 	var payload Addr
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
-
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
+	addKnownNodes(payload.AddrList...)
+	fmt.Printf("there are %d known nodes\n", len(knownNodes()))
+	if err := savePeers(); err != nil {
+		fmt.Printf("Failed to save the known nodes: %s\n", err)
+	}
 	RequestBlocks()
+
+	return nil
 }
 
-func HandleBlock(request []byte, chain *blockchain.Blockchain) {
+func HandleBlock(request []byte, chain *blockchain.Blockchain) error {
 	var buff bytes.Buffer
 	var payload Block
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.Deserialize(blockData)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	_, err = chain.GetBlock(block.Hash)
+	known := err == nil || err == blockchain.ErrBlockPruned
+	if !known && !errors.Is(err, blockchain.ErrNotFound) {
+		return err
+	}
+
+	// The chain validates the block and connects it, or switches to it when it is the tip of a longer branch
+	if !known {
+		err := chain.AddBlock(block)
+		if errors.Is(err, blockchain.ErrInvalidBlock) {
+			fmt.Println(err)
+			return nil
+		} else if errors.Is(err, blockchain.ErrBlockPruned) || errors.Is(err, blockchain.ErrUndoNotAvailable) {
+			fmt.Printf("Block %x forks below the blocks this node can revert: %s\n", block.Hash, err)
+		} else if err != nil {
+			return err
+		} else {
+			fmt.Printf("Added block %x\n", block.Hash)
+		}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
+		if bytes.Equal(chain.LastHash(), block.Hash) {
+			pool.RemoveBlock(block)
+			if err := pruneChain(chain); err != nil {
+				return err
+			}
+		}
+	}
+
+	if blockHash, ok := nextBlockInTransit(); ok {
 		SendGetData(payload.AddrFrom, "block", blockHash)
+	}
+
+	return nil
+}
 
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
+// Blocks come from the tip down, so when a node prunes it only looks at the newest ones
+func pruneChain(chain *blockchain.Blockchain) error {
+	if PruneDepth > 0 {
+		pruned, err := chain.Prune(PruneDepth)
+		if err != nil {
+			return err
+		}
+		if pruned > 0 {
+			fmt.Printf("Pruned %d blocks\n", pruned)
+		}
 	}
+
+	return nil
 }
 
-func HandleInventory(request []byte, chain *blockchain.Blockchain) {
+func HandleGetHeaders(request []byte, chain *blockchain.Blockchain) error {
 	var buff bytes.Buffer
-	var payload Inventory
+	var payload GetHeaders
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+
+	headers, err := chain.GetHeaders()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+	SendHeaders(payload.AddrFrom, headers)
 
-	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
+	return nil
+}
+
+/*
+	The headers drive the download of the blocks. They must start at our genesis, be linked to each
+	other and have a valid proof of work, then the blocks we are missing are asked for oldest first.
+	A chain that is not longer than ours can't become the tip, so its blocks are not downloaded
+*/
+func HandleHeaders(request []byte, chain *blockchain.Blockchain) error {
+	var buff bytes.Buffer
+	var payload Headers
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+
+	var headers []*blockchain.Block
+	var prevHash []byte
+	for height, data := range payload.Headers {
+		header, err := blockchain.Deserialize(data)
+		if err != nil {
+			return err
+		}
+		pow := blockchain.NewProof(header)
+		if !bytes.Equal(header.PrevHash, prevHash) || header.Height != height || !pow.Validate() || !bytes.Equal(pow.Hash(), header.Hash) {
+			fmt.Printf("Received invalid header %x from %s\n", header.Hash, payload.AddrFrom)
+			return nil
+		}
+		headers = append(headers, header)
+		prevHash = header.Hash
+	}
+
+	fmt.Printf("Received %d valid headers from %s\n", len(headers), payload.AddrFrom)
+	if len(headers) == 0 {
+		return nil
+	}
 
+	if _, err := chain.GetBlock(headers[0].Hash); errors.Is(err, blockchain.ErrNotFound) {
+		fmt.Printf("Headers from %s start at another genesis block\n", payload.AddrFrom)
+		return nil
+	} else if err != nil && err != blockchain.ErrBlockPruned {
+		return err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if headers[len(headers)-1].Height <= bestHeight {
+		return nil
+	}
+
+	var missing [][]byte
+	for _, header := range headers {
+		if _, err := chain.GetBlock(header.Hash); errors.Is(err, blockchain.ErrNotFound) {
+			missing = append(missing, header.Hash)
+		} else if err != nil && err != blockchain.ErrBlockPruned {
+			return err
+		}
+	}
+	requestBlocks(payload.AddrFrom, missing)
+
+	return nil
+}
+
+/*
+	Asks the peer for the first block and keeps the others to ask for them as each one arrives. There
+	is a single download, the last headers or inventory received replace the blocks still in transit
+*/
+func requestBlocks(address string, hashes [][]byte) {
+	if len(hashes) == 0 {
+		return
+	}
+
+	setBlocksInTransit(hashes[1:])
+	SendGetData(address, "block", hashes[0])
+}
+
+var transitMutex sync.Mutex // Guards blocksInTransit, the blocks arrive on the connections of several peers
+
+func setBlocksInTransit(hashes [][]byte) {
+	transitMutex.Lock()
+	defer transitMutex.Unlock()
+
+	blocksInTransit = hashes
+}
+
+// Takes the next block to ask for, if any is left
+func nextBlockInTransit() ([]byte, bool) {
+	transitMutex.Lock()
+	defer transitMutex.Unlock()
+
+	if len(blocksInTransit) == 0 {
+		return nil, false
+	}
+	blockHash := blocksInTransit[0]
+	blocksInTransit = blocksInTransit[1:]
+
+	return blockHash, true
+}
+
+func HandleNotFound(request []byte) error {
+	var buff bytes.Buffer
+	var payload NotFound
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s doesn't have %s %x\n", payload.AddrFrom, payload.Type, payload.ID)
+
+	// The blocks after a missing one can't be connected either
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+		setBlocksInTransit([][]byte{})
+	}
 
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+	return nil
+}
+
+func HandleInventory(request []byte, chain *blockchain.Blockchain) error {
+	var buff bytes.Buffer
+	var payload Inventory
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+
+	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
 
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	if payload.Type == "block" {
+		// The hashes come from the tip down, we ask for the missing ones oldest first so each block extends our tip
+		var missing [][]byte
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if _, err := chain.GetBlock(payload.Items[i]); errors.Is(err, blockchain.ErrNotFound) {
+				missing = append(missing, payload.Items[i])
+			} else if err != nil && err != blockchain.ErrBlockPruned {
+				return err
 			}
 		}
-		blocksInTransit = newInTransit
+
+		requestBlocks(payload.AddrFrom, missing)
 	}
 
 	if payload.Type == "tx" {
+		if len(payload.Items) == 0 {
+			return errors.New("Inventory of transactions without items")
+		}
 		txID := payload.Items[0]
 
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
+		if !pool.Has(txID) {
 			SendGetData(payload.AddrFrom, "tx", txID)
 		}
 	}
+
+	return nil
 }
 
-func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) {
+func HandleGetBlocks(request []byte, chain *blockchain.Blockchain) error {
 	var buff bytes.Buffer
 	var payload GetBlocks
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
-	blocks := chain.GetBlockHashes()
+	blocks, err := chain.GetBlockHashes()
+	if err != nil {
+		return err
+	}
 	SendInventory(payload.AddrFrom, "block", blocks)
+
+	return nil
 }
 
-func HandleGetData(request []byte, chain *blockchain.Blockchain) {
+func HandleGetData(request []byte, chain *blockchain.Blockchain) error {
 	var buff bytes.Buffer
 	var payload GetData
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
 	if payload.Type == "block" {
 		block, err := chain.GetBlock([]byte(payload.ID))
-		if err != nil {
-			return
+		if err == blockchain.ErrBlockPruned || errors.Is(err, blockchain.ErrNotFound) {
+			SendNotFound(payload.AddrFrom, "block", payload.ID)
+			return nil
+		} else if err != nil {
+			return err
 		}
 
 		SendBlock(payload.AddrFrom, &block)
 	}
 
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		tx, ok := pool.Get(payload.ID)
+		if !ok {
+			SendNotFound(payload.AddrFrom, "tx", payload.ID)
+			return nil
+		}
+
+		SendTx(payload.AddrFrom, tx)
+	}
+
+	return nil
+}
+
+// A regtest node keeps nothing on disk, its memory pool is lost with its chain
+func saveMempool() error {
+	if pool == nil || Regtest {
+		return nil
+	}
+	if err := pool.Save(mempoolFile); err != nil {
+		return err
+	}
+	if err := pool.Estimator().Save(feesFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved %d transactions of the memory pool\n", pool.Count())
 
-		SendTx(payload.AddrFrom, &tx)
+	return nil
+}
+
+// Saves the memory pool from time to time, so a node that crashes loses only the last transactions
+func saveMempoolEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := saveMempool(); err != nil {
+			fmt.Printf("Failed to save the memory pool: %s\n", err)
+		}
 	}
 }
 
-func HandleTx(request []byte, chain *blockchain.Blockchain) {
+/*
+	Keeps the memory pool in step with the chain. When the chain switches to another branch the
+	transactions of the disconnected blocks go back to the pool if they are still valid, and the ones
+	of the connected blocks leave it. Blocks mined or received on top of the tip were usually
+	removed already, the pool only removes a block once
+*/
+func followChain(sub *blockchain.Subscription) {
+	for event := range sub.C {
+		switch event.Type {
+		case blockchain.BlockDisconnected:
+			if returned := pool.ReturnBlock(event.Block); returned > 0 {
+				fmt.Printf("%d transactions of the disconnected block %x are back in the memory pool\n", returned, event.Block.Hash)
+			}
+		case blockchain.BlockConnected:
+			pool.RemoveBlock(event.Block)
+		}
+	}
+}
+
+func HandleTx(request []byte, chain *blockchain.Blockchain) error {
 	var buff bytes.Buffer
 	var payload Tx
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		return err
+	}
+
+	// A transaction rejected by our pool is not relayed, but it is not an error of the connection
+	if err := pool.Add(&tx); err != nil {
+		fmt.Printf("Transaction %x rejected: %s\n", tx.ID, err)
+		return nil
+	}
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	fmt.Printf("%s, %d", nodeAddress, pool.Count())
 
-	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
+	if nodes := knownNodes(); len(nodes) > 0 && nodeAddress == nodes[0] {
+		for _, node := range nodes {
 			if node != nodeAddress && node != payload.AddrFrom {
 				SendInventory(node, "tx", [][]byte{tx.ID})
 			}
 		}
-	} else {
-		if len(memoryPool) >= 2 && len(mineAddress) > 0 {
-			MineTx(chain)
-		}
 	}
+	notifyMiner()
+
+	return nil
 }
 
-func MineTx(chain *blockchain.Blockchain) {
-	var txs []*blockchain.Transaction
+func isMiningPaused() bool {
+	return atomic.LoadInt32(&miningPaused) == 1
+}
 
-	for id := range memoryPool {
-		fmt.Printf("tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
+// Never blocks, a miner that is busy checks the pool again when it finishes its block anyway
+func notifyMiner() {
+	select {
+	case mineSignal <- struct{}{}:
+	default:
 	}
+}
 
-	if len(txs) == 0 {
-		fmt.Println("All Transactions are invalid")
-		return
+/*
+	Mines the blocks of the node as its MiningPolicy says. It is the only goroutine that mines, so
+	the blocks of the node never compete with each other for the same height
+*/
+func runMiner(chain *blockchain.Blockchain) {
+	var tick <-chan time.Time
+	if MiningPolicy.Trigger == mining.TriggerInterval {
+		ticker := time.NewTicker(MiningPolicy.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
-
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	for {
+		var err error
 
-	fmt.Println("New Block mined")
+		switch MiningPolicy.Trigger {
+		case mining.TriggerCount:
+			<-mineSignal
+			if !isMiningPaused() {
+				err = MineTx(chain)
+			}
+		case mining.TriggerInterval:
+			<-tick
+			if !isMiningPaused() {
+				err = mineTemplate(chain)
+			}
+		case mining.TriggerContinuous:
+			if isMiningPaused() {
+				<-mineSignal
+				continue
+			}
+			err = mineTemplate(chain)
+		}
 
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+		if err != nil {
+			fmt.Printf("Failed to mine a block: %s\n", err)
+		}
 	}
+}
 
-	for _, node := range KnownNodes {
-		if node != nodeAddress {
-			SendInventory(node, "block", [][]byte{newBlock.Hash})
+/*
+	Mines blocks with the transactions of the memory pool while it has at least MinTxs of them,
+	the pool verified them already
+*/
+func MineTx(chain *blockchain.Blockchain) error {
+	for pool.Count() >= MiningPolicy.MinTxs && !isMiningPaused() {
+		template, err := mining.NewBlockTemplate(chain, pool, mineAddress, MaxBlockSize)
+		if err != nil {
+			return err
+		}
+		if len(template.Transactions) == 0 {
+			fmt.Println("No transactions to mine")
+			return nil
+		}
+
+		if err := mineBlock(chain, template); err != nil {
+			return err
 		}
 	}
 
-	if len(memoryPool) > 0 {
-		MineTx(chain)
+	return nil
+}
+
+// Mines a block with the best transactions of the memory pool, or an empty one when there are none
+func mineTemplate(chain *blockchain.Blockchain) error {
+	template, err := mining.NewBlockTemplate(chain, pool, mineAddress, MaxBlockSize)
+	if err != nil {
+		return err
 	}
+
+	return mineBlock(chain, template)
 }
 
-func HandleVersion(request []byte, chain *blockchain.Blockchain) {
-	var buff bytes.Buffer
-	var payload Version
+func mineBlock(chain *blockchain.Blockchain, template *mining.BlockTemplate) error {
+	for _, desc := range template.Transactions {
+		fmt.Printf("tx: %x\n", desc.Tx.ID)
+	}
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	newBlock, err := chain.MineBlock(template.BlockTransactions())
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	if err := pruneChain(chain); err != nil {
+		return err
 	}
 
-	bestHeight := chain.GetBestHeight()
-	otherHeight := payload.BestHeight
+	fmt.Printf("New Block mined with %d transactions paying %d in fees\n", len(template.Transactions), template.Fees)
 
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
-	} else if bestHeight > otherHeight {
-		SendVersion(payload.AddrFrom, chain)
-	}
+	pool.RemoveBlock(newBlock)
+	announceBlock(newBlock)
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	return nil
+}
+
+func announceBlock(block *blockchain.Block) {
+	for _, node := range knownNodes() {
+		if node != nodeAddress {
+			SendInventory(node, "block", [][]byte{block.Hash})
+		}
 	}
 }
 
-func HandleConnection(conn net.Conn, chain *blockchain.Blockchain) {
-	req, err := ioutil.ReadAll(conn)
-	defer conn.Close()
+// Gives work to the external miners, their blocks are pruned and announced like the ones of the node
+func serveWork(chain *blockchain.Blockchain) error {
+	ln, err := net.Listen(protocol, WorkAddress)
+	if err != nil {
+		return err
+	}
+
+	server := mining.NewWorkServer(chain, pool, mineAddress, MaxBlockSize, func(block *blockchain.Block) {
+		if err := pruneChain(chain); err != nil {
+			fmt.Printf("Failed to prune the chain: %s\n", err)
+		}
+		announceBlock(block)
+	})
+	fmt.Printf("Serving work to external miners on %s\n", WorkAddress)
+
+	go func() {
+		defer ln.Close()
+		if err := server.Serve(ln); err != nil {
+			fmt.Printf("Work server stopped: %s\n", err)
+		}
+	}()
+
+	return nil
+}
 
+// Reads the messages of a peer that connected to the node until it disconnects
+func HandleConnection(conn net.Conn) {
+	p, err := newPeer(conn, "", false)
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to accept %s: %s\n", conn.RemoteAddr(), err)
+		return
 	}
+	p.readLoop()
+}
+
+// A failing request is reported and dropped, it never takes the node down
+func handleRequest(req []byte, chain *blockchain.Blockchain) {
+	var err error
+
 	command := BytesToCmd(req[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
+	// A message the handler didn't expect must not stop the node with every other peer
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Failed to handle %s command: %v\n", command, r)
+		}
+	}()
+
 	switch command {
 	case "addr":
-		HandleAddr(req)
+		err = HandleAddr(req)
 	case "block":
-		HandleBlock(req, chain)
+		err = HandleBlock(req, chain)
 	case "inv":
-		HandleInventory(req, chain)
+		err = HandleInventory(req, chain)
 	case "getblocks":
-		HandleGetBlocks(req, chain)
+		err = HandleGetBlocks(req, chain)
 	case "getdata":
-		HandleGetData(req, chain)
+		err = HandleGetData(req, chain)
 	case "tx":
-		HandleTx(req, chain)
-	case "version":
-		HandleVersion(req, chain)
+		err = HandleTx(req, chain)
+	case "getheaders":
+		err = HandleGetHeaders(req, chain)
+	case "headers":
+		err = HandleHeaders(req, chain)
+	case "notfound":
+		err = HandleNotFound(req)
 	default:
 		fmt.Println("Unknown command")
 	}
 
+	if err != nil {
+		fmt.Printf("Failed to handle %s command: %s\n", command, err)
+	}
 }
 
-func StartServer(nodeID, minerAddress string) {
+func StartServer(nodeID, minerAddress string) error {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	mineAddress = minerAddress
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	defer ln.Close()
 
-	chain := blockchain.ContinueBlockchain(nodeID)
+	chain, err := openNodeChain(nodeID)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
+	nodeChain = chain
+
+	pool = mempool.New(chain, MempoolPolicy)
+	if !Regtest {
+		// The saved transactions are checked again, the chain may have moved while the node was stopped
+		mempoolFile = datadir.MempoolFile(nodeID)
+		accepted, rejected, err := pool.Load(mempoolFile)
+		if err != nil {
+			fmt.Printf("Failed to load the memory pool: %s\n", err)
+		} else if accepted+rejected > 0 {
+			fmt.Printf("Loaded %d transactions of the memory pool, %d were dropped\n", accepted, rejected)
+		}
+		feesFile = datadir.FeeEstimatesFile(nodeID)
+		if err := pool.Estimator().Load(feesFile); err != nil {
+			fmt.Printf("Failed to load the fee estimates: %s\n", err)
+		}
+		peersFile = datadir.PeersFile(nodeID)
+		if added, err := loadPeers(peersFile); err != nil {
+			fmt.Printf("Failed to load the known nodes: %s\n", err)
+		} else if added > 0 {
+			fmt.Printf("Loaded %d known nodes\n", added)
+		}
+	}
+
+	// Even a regtest node needs its directory for the socket
+	if err := datadir.Create(nodeID); err != nil {
+		return err
+	}
+	control, err := listenControl(datadir.ControlSocket(nodeID))
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	controlFile = datadir.ControlSocket(nodeID)
+	go serveControl(control)
+
 	go CloseDB(chain)
+	go saveMempoolEvery(mempoolSaveInterval)
+	go followChain(chain.Events.Subscribe(blockchain.DefaultEventBuffer, blockchain.BlockConnected, blockchain.BlockDisconnected))
+	if len(mineAddress) > 0 && MiningPolicy.Trigger != mining.TriggerNone {
+		go runMiner(chain)
+		// Transactions loaded from the saved pool may already be enough to mine
+		notifyMiner()
+	}
+	if len(mineAddress) > 0 && len(WorkAddress) > 0 {
+		if err := serveWork(chain); err != nil {
+			return err
+		}
+	}
 
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+	// The handshake with the main node tells which of the two is missing blocks
+	if nodes := knownNodes(); len(nodes) > 0 && nodeAddress != nodes[0] {
+		if _, err := connectPeer(nodes[0]); err != nil {
+			fmt.Printf("%s is not available: %s\n", nodes[0], err)
+		}
 	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		go HandleConnection(conn, chain)
+		go HandleConnection(conn)
+
+	}
+}
 
+// A regtest node starts from the regtest genesis in a memory store every time it is started
+func openNodeChain(nodeID string) (*blockchain.Blockchain, error) {
+	if Regtest {
+		return blockchain.InitRegtestInStore(storage.NewMemoryStore())
 	}
+
+	return blockchain.ContinueBlockchain(nodeID)
 }
 
+// Only fails for types gob can't encode, which is a bug in this package
 func GobEncode(data interface{}) []byte {
 	var buff bytes.Buffer
 
@@ -478,22 +942,21 @@ func GobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func NodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
-}
-
 func CloseDB(chain *blockchain.Blockchain) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
 		defer runtime.Goexit()
+		if err := saveMempool(); err != nil {
+			fmt.Printf("Failed to save the memory pool: %s\n", err)
+		}
+		if err := savePeers(); err != nil {
+			fmt.Printf("Failed to save the known nodes: %s\n", err)
+		}
+		if controlFile != "" {
+			os.Remove(controlFile)
+		}
 		chain.Database.Close()
 	})
 }
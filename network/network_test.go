@@ -0,0 +1,30 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestHandleInventoryRejectsMalformedPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"transactions without items", GobEncode(Inventory{"localhost:3999", "tx", nil})},
+		{"payload that is not gob", []byte("not gob")},
+		{"empty payload", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := HandleInventory(append(CmdToBytes("inv"), test.payload...), nil); err == nil {
+				t.Fatal("Malformed inventory accepted")
+			}
+		})
+	}
+}
+
+// A handler that panics on a message must not stop the node with every other peer
+func TestHandleRequestRecovers(t *testing.T) {
+	// Without a chain the handler panics looking up the block
+	request := append(CmdToBytes("inv"), GobEncode(Inventory{"localhost:3999", "block", [][]byte{{1}}})...)
+	handleRequest(request, nil)
+}
@@ -0,0 +1,275 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/blockchain-app-go/blockchain"
+)
+
+/*
+	Nodes keep a connection open to every peer they talk to and send all their messages over it, in
+	both directions. Every message is framed by a header:
+
+		magic     4 bytes   identifies the network, anything else means the stream is broken
+		command   12 bytes  the command, as written by CmdToBytes
+		length    4 bytes   bytes of the payload, big endian
+		checksum  4 bytes   first bytes of the double SHA-256 of the payload
+
+	A message with a wrong checksum is dropped and the connection goes on, since its length still
+	says where the next message starts. A wrong magic or a connection closed in the middle of a
+	message closes the connection. Until the handshake completes a message can't be bigger than a
+	version needs, so a peer can't make the node hold big payloads before it is even known
+*/
+
+const (
+	headerLength   = 4 + commandLength + 4 + 4
+	maxPayloadSize = 32 << 20 // Bigger messages are refused before their payload is read
+	maxVersionSize = 4 << 10  // Limit until the handshake completes, a version is much smaller
+	dialTimeout    = 10 * time.Second
+	writeTimeout   = 30 * time.Second
+	peerQueueSize  = 100 // Messages of a peer waiting to be handled before its connection stops being read
+)
+
+var (
+	networkMagic = []byte{0xfa, 0xbf, 0xb5, 0xda}
+
+	errBadMagic    = errors.New("Message doesn't start with the network magic")
+	errBadChecksum = errors.New("Payload doesn't match the checksum of the message")
+	errTooLarge    = errors.New("Message is bigger than the maximum payload size")
+	errQueueFull   = errors.New("Peer sends messages faster than they are handled")
+)
+
+type peer struct {
+	conn     net.Conn
+	address  string     // Address the peer listens on, empty until an inbound peer sends its version. Guarded by peersMutex
+	outbound bool       // The node dialed the peer, so it sends its version first
+	mutex    sync.Mutex // Held while writing, so the messages of different goroutines never mix
+
+	// Only changed by the goroutine reading from the peer
+	version *Version      // Set when the version of the peer arrives
+	verack  bool          // The peer accepted the version of the node
+	ready   chan struct{} // Closed once the handshake is complete
+	done    chan struct{} // Closed when the connection is closed
+	once    sync.Once
+
+	requests chan []byte // Messages after the handshake, handled one after the other by handleLoop
+}
+
+var (
+	peersMutex sync.Mutex
+	peers      = make(map[string]*peer) // Open connections by the address the peer listens on
+	nodeChain  *blockchain.Blockchain   // Chain of the running node, nil in the commands that only send
+)
+
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:4]
+}
+
+// Writes a request, a command from CmdToBytes followed by its payload, as a framed message
+func writeMessage(w io.Writer, request []byte) error {
+	if len(request) < commandLength {
+		return errors.New("Request is too short")
+	}
+	payload := request[commandLength:]
+	if len(payload) > maxPayloadSize {
+		return errTooLarge
+	}
+
+	var message bytes.Buffer
+	message.Write(networkMagic)
+	message.Write(request[:commandLength])
+	binary.Write(&message, binary.BigEndian, uint32(len(payload)))
+	message.Write(checksum(payload))
+	message.Write(payload)
+
+	_, err := w.Write(message.Bytes())
+
+	return err
+}
+
+/*
+	Reads the next framed message and returns it as a request, the command followed by the payload.
+	The length in the header is only a claim, so the payload is read into a buffer that grows as its
+	bytes arrive instead of being allocated up front
+*/
+func readMessage(r io.Reader, limit uint32) ([]byte, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], networkMagic) {
+		return nil, errBadMagic
+	}
+
+	command := header[4 : 4+commandLength]
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	if length > limit {
+		return nil, errTooLarge
+	}
+
+	var payload bytes.Buffer
+	if _, err := io.CopyN(&payload, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[headerLength-4:], checksum(payload.Bytes())) {
+		return nil, fmt.Errorf("%w of %s", errBadChecksum, BytesToCmd(command))
+	}
+
+	return append(append([]byte{}, command...), payload.Bytes()...), nil
+}
+
+// The handshake must complete before the timeout, an inbound peer that stays silent is disconnected
+func newPeer(conn net.Conn, address string, outbound bool) (*peer, error) {
+	p := &peer{conn: conn, address: address, outbound: outbound, ready: make(chan struct{}), done: make(chan struct{}), requests: make(chan []byte, peerQueueSize)}
+	if err := conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+/*
+	Returns the open connection to the address, or dials one and waits for the handshake. The lock
+	is not held meanwhile, so two nodes dialing each other don't wait for each other
+*/
+func connectPeer(address string) (*peer, error) {
+	peersMutex.Lock()
+	p, ok := peers[address]
+	peersMutex.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	conn, err := net.DialTimeout(protocol, address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p, err = newPeer(conn, address, true)
+	if err != nil {
+		return nil, err
+	}
+
+	go p.readLoop()
+	if err := p.sendVersion(); err != nil {
+		p.close()
+		return nil, err
+	}
+
+	select {
+	case <-p.ready:
+	case <-p.done:
+		return nil, fmt.Errorf("%s closed the connection during the handshake", address)
+	}
+
+	// The peer may have connected to the node at the same time, its connection is used then
+	peersMutex.Lock()
+	registered := peers[address]
+	peersMutex.Unlock()
+	if registered == nil {
+		return nil, fmt.Errorf("%s closed the connection after the handshake", address)
+	} else if registered != p {
+		p.close()
+		return registered, nil
+	}
+
+	return p, nil
+}
+
+func (p *peer) send(request []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	return writeMessage(p.conn, request)
+}
+
+// Closes the connection and forgets it, so the next message to the peer dials again
+func (p *peer) close() {
+	p.conn.Close()
+	p.once.Do(func() { close(p.done) })
+
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	if p.address != "" && peers[p.address] == p {
+		delete(peers, p.address)
+	}
+}
+
+/*
+	Reads the messages of the peer until the connection breaks. The handshake is handled here, every
+	other message is queued for handleLoop. The messages of a peer are handled in the order they were
+	sent, so the blocks it sends arrive oldest first like they were asked for, while the messages of
+	different peers are handled at the same time
+*/
+func (p *peer) readLoop() {
+	defer p.close()
+	go p.handleLoop()
+	defer close(p.requests)
+
+	reader := bufio.NewReader(p.conn)
+	for {
+		var limit uint32 = maxVersionSize
+		if p.version != nil && p.verack {
+			limit = maxPayloadSize
+		}
+
+		request, err := readMessage(reader, limit)
+		if errors.Is(err, errBadChecksum) {
+			fmt.Printf("Dropped a message from %s: %s\n", p.conn.RemoteAddr(), err)
+			continue
+		} else if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Printf("Closing the connection with %s: %s\n", p.conn.RemoteAddr(), err)
+			return
+		}
+
+		switch command := BytesToCmd(request[:commandLength]); command {
+		case "version":
+			err = p.handleVersion(request)
+		case "verack":
+			err = p.handleVerack()
+		default:
+			if p.version == nil || !p.verack {
+				err = fmt.Errorf("%w: %s", errNoHandshake, command)
+			} else if nodeChain != nil {
+				// Blocking here could stall two peers handling each other's messages, so a peer that fills its queue is disconnected
+				select {
+				case p.requests <- request:
+				default:
+					err = errQueueFull
+				}
+			}
+		}
+		if err != nil {
+			fmt.Printf("Closing the connection with %s: %s\n", p.describe(), err)
+			return
+		}
+	}
+}
+
+// Handles the queued messages of the peer one at a time, until the connection is closed
+func (p *peer) handleLoop() {
+	for request := range p.requests {
+		handleRequest(request, nodeChain)
+	}
+}
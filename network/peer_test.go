@@ -0,0 +1,185 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func frame(t *testing.T, command string, payload []byte) []byte {
+	t.Helper()
+
+	var message bytes.Buffer
+	if err := writeMessage(&message, append(CmdToBytes(command), payload...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return message.Bytes()
+}
+
+func TestReadMessage(t *testing.T) {
+	valid := frame(t, "inv", []byte("payload"))
+
+	badMagic := append([]byte{}, valid...)
+	badMagic[0] ^= 0xff
+
+	badChecksum := append([]byte{}, valid...)
+	badChecksum[headerLength-1] ^= 0xff
+
+	// Only the header is sent, the payload must not be waited for nor allocated
+	oversized := append([]byte{}, valid[:headerLength]...)
+	binary.BigEndian.PutUint32(oversized[4+commandLength:], maxVersionSize+1)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		limit uint32
+		err   error
+	}{
+		{"valid", valid, maxVersionSize, nil},
+		{"bad magic", badMagic, maxVersionSize, errBadMagic},
+		{"bad checksum", badChecksum, maxVersionSize, errBadChecksum},
+		{"oversized before the handshake", oversized, maxVersionSize, errTooLarge},
+		{"oversized after the handshake", oversized[:4+commandLength], maxPayloadSize, io.ErrUnexpectedEOF},
+		{"truncated payload", valid[:len(valid)-1], maxVersionSize, io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := readMessage(bytes.NewReader(test.data), test.limit)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Got error %v, expected %v", err, test.err)
+			}
+			if err == nil && (BytesToCmd(request[:commandLength]) != "inv" || string(request[commandLength:]) != "payload") {
+				t.Fatalf("Read %q", request)
+			}
+		})
+	}
+}
+
+func TestBadChecksumKeepsTheStream(t *testing.T) {
+	broken := frame(t, "inv", []byte("first"))
+	broken[len(broken)-1] ^= 0xff
+	reader := bytes.NewReader(append(broken, frame(t, "inv", []byte("second"))...))
+
+	if _, err := readMessage(reader, maxVersionSize); !errors.Is(err, errBadChecksum) {
+		t.Fatalf("Got error %v, expected %v", err, errBadChecksum)
+	}
+	request, err := readMessage(reader, maxVersionSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request[commandLength:]) != "second" {
+		t.Fatalf("Read %q after the dropped message", request)
+	}
+}
+
+/*
+	Opens a connection to an inbound peer of the node over the loopback. The messages of the node are
+	read in the background, the returned channel is closed when the node closes the connection
+*/
+func connectInbound(t *testing.T) (net.Conn, chan struct{}) {
+	t.Helper()
+
+	listener, err := net.Listen(protocol, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if p, err := newPeer(conn, "", false); err == nil {
+			p.readLoop()
+		}
+	}()
+
+	conn, err := net.Dial(protocol, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, err := readMessage(conn, maxPayloadSize); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn, closed
+}
+
+func versionMessage(t *testing.T, addrFrom string) []byte {
+	t.Helper()
+
+	return frame(t, "version", GobEncode(Version{version, 0, addrFrom, 0, userAgent, time.Now().Unix()}))
+}
+
+func TestHandshake(t *testing.T) {
+	oversized := frame(t, "version", nil)
+	binary.BigEndian.PutUint32(oversized[4+commandLength:], maxPayloadSize)
+
+	tests := []struct {
+		name     string
+		messages func(t *testing.T) [][]byte
+		closed   bool
+	}{
+		{"complete", func(t *testing.T) [][]byte {
+			return [][]byte{versionMessage(t, "localhost:3999"), frame(t, "verack", GobEncode(Verack{}))}
+		}, false},
+		{"message before the handshake", func(t *testing.T) [][]byte {
+			return [][]byte{frame(t, "getblocks", GobEncode(GetBlocks{}))}
+		}, true},
+		{"message before the verack", func(t *testing.T) [][]byte {
+			return [][]byte{versionMessage(t, ""), frame(t, "getblocks", GobEncode(GetBlocks{}))}
+		}, true},
+		{"duplicate version", func(t *testing.T) [][]byte {
+			return [][]byte{versionMessage(t, ""), versionMessage(t, "")}
+		}, true},
+		{"version claiming another host", func(t *testing.T) [][]byte {
+			return [][]byte{versionMessage(t, "192.0.2.1:3000")}
+		}, true},
+		{"oversized message before the handshake", func(t *testing.T) [][]byte {
+			return [][]byte{oversized}
+		}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, closed := connectInbound(t)
+			for _, message := range test.messages(t) {
+				if _, err := conn.Write(message); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case <-closed:
+				if !test.closed {
+					t.Fatal("The node closed the connection")
+				}
+			case <-time.After(time.Second):
+				if test.closed {
+					t.Fatal("The node kept the connection open")
+				}
+				peersMutex.Lock()
+				_, registered := peers["localhost:3999"]
+				peersMutex.Unlock()
+				if !registered {
+					t.Fatal("The peer that completed the handshake was not registered")
+				}
+			}
+		})
+	}
+}
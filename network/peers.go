@@ -0,0 +1,108 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+var (
+	peersFile  string     // File where the known nodes are saved, empty when they are not saved
+	nodesMutex sync.Mutex // Guards KnownNodes, the handlers of every peer read and change it
+)
+
+// A copy of the known nodes, the main node first
+func knownNodes() []string {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+
+	return append([]string{}, KnownNodes...)
+}
+
+// Adds the nodes that are not known yet, it returns how many were added
+func addKnownNodes(nodes ...string) int {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+
+	added := 0
+	for _, node := range nodes {
+		if node != nodeAddress && !nodeIsKnown(node) {
+			KnownNodes = append(KnownNodes, node)
+			added++
+		}
+	}
+
+	return added
+}
+
+func removeKnownNode(addr string) {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+
+	var updatedNodes []string
+	for _, node := range KnownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+	KnownNodes = updatedNodes
+}
+
+func NodeIsKnown(addr string) bool {
+	nodesMutex.Lock()
+	defer nodesMutex.Unlock()
+
+	return nodeIsKnown(addr)
+}
+
+// The caller must hold nodesMutex
+func nodeIsKnown(addr string) bool {
+	for _, node := range KnownNodes {
+		if node == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Adds the nodes saved by the last run to the known ones, after the main node so it is still the
+	first one. A missing file is not an error, the node only knows the main node then
+*/
+func loadPeers(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var nodes []string
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&nodes); err != nil {
+		return 0, err
+	}
+
+	return addKnownNodes(nodes...), nil
+}
+
+// Written next to the old file and renamed over it like the memory pool
+func savePeers() error {
+	if peersFile == "" {
+		return nil
+	}
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(knownNodes()); err != nil {
+		return err
+	}
+
+	tmp := peersFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, peersFile)
+}
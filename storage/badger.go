@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The default store, a badger database in a directory
+type BadgerStore struct {
+	db *badger.DB
+}
+
+type badgerBatch struct {
+	txn *badger.Txn
+}
+
+func BadgerExists(dir string) bool {
+	if _, err := os.Stat(dir + "/MANIFEST"); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK")
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	}
+	retryOpts := originalOpts
+	retryOpts.Truncate = true
+	db, err := badger.Open(retryOpts)
+	return db, err
+}
+
+// Opens or creates the database, a lock left by a node that crashed is removed
+func OpenBadger(dir string) (*BadgerStore, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+
+	if db, err := badger.Open(opts); err != nil {
+		if strings.Contains(err.Error(), "LOCK") {
+			if db, err := retry(dir, opts); err == nil {
+				log.Println("database unlocked, value log truncated")
+				return &BadgerStore{db}, nil
+			}
+			log.Println("could not unlock database:", err)
+		}
+		return nil, err
+	} else {
+		return &BadgerStore{db}, nil
+	}
+}
+
+func (s *BadgerStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		value, err = badgerBatch{txn}.Get(key)
+		return err
+	})
+
+	return value, err
+}
+
+func (s *BadgerStore) Put(key, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+func (s *BadgerStore) Delete(key []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (s *BadgerStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *BadgerStore) Update(fn func(batch Batch) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerBatch{txn})
+	})
+}
+
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+func (b badgerBatch) Get(key []byte) ([]byte, error) {
+	item, err := b.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+func (b badgerBatch) Put(key, value []byte) error {
+	return b.txn.Set(key, value)
+}
+
+func (b badgerBatch) Delete(key []byte) error {
+	return b.txn.Delete(key)
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	A store that only lives in memory, for tests and for nodes that don't need to keep their chain.
+	Batches hold the lock of the store while they run, so they must not use the store itself
+*/
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+type memoryBatch struct {
+	store   *MemoryStore
+	pending map[string][]byte // A nil value is a deleted key
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyBytes(value), nil
+}
+
+func (s *MemoryStore) Put(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[string(key)] = copyBytes(value)
+	return nil
+}
+
+func (s *MemoryStore) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, string(key))
+	return nil
+}
+
+// The matching entries are copied first, so fn can write to the store while iterating
+func (s *MemoryStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	s.mu.RLock()
+	var keys []string
+	for key := range s.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = copyBytes(s.data[key])
+	}
+	s.mu.RUnlock()
+
+	for i, key := range keys {
+		if err := fn([]byte(key), values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Update(fn func(batch Batch) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := &memoryBatch{s, make(map[string][]byte)}
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	for key, value := range batch.pending {
+		if value == nil {
+			delete(s.data, key)
+		} else {
+			s.data[key] = value
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (b *memoryBatch) Get(key []byte) ([]byte, error) {
+	value, ok := b.pending[string(key)]
+	if !ok {
+		value, ok = b.store.data[string(key)]
+	}
+	if !ok || value == nil {
+		return nil, ErrNotFound
+	}
+
+	return copyBytes(value), nil
+}
+
+func (b *memoryBatch) Put(key, value []byte) error {
+	b.pending[string(key)] = copyBytes(value)
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	b.pending[string(key)] = nil
+	return nil
+}
+
+// Empty values are stored as empty slices, never nil, which marks deleted keys in a batch
+func copyBytes(value []byte) []byte {
+	return append([]byte{}, value...)
+}
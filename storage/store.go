@@ -0,0 +1,30 @@
+package storage
+
+import "errors"
+
+var ErrNotFound = errors.New("Not found")
+
+/*
+	A Store keeps the keys sorted so they can be iterated by prefix, which is how the blockchain
+	separates the blocks, the UTXO set and the other records in a single key-value space
+*/
+type Store interface {
+	Get(key []byte) ([]byte, error) // Returns ErrNotFound when the key is not in the store
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	// Calls fn with copies of the keys and values starting with prefix in key order, an error stops the iteration
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+
+	// Runs fn in a batch that is written atomically, nothing is written when fn returns an error
+	Update(fn func(batch Batch) error) error
+
+	Close() error
+}
+
+// The writes of a batch are seen by its own reads before they are committed
+type Batch interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
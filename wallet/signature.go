@@ -0,0 +1,174 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+/*
+	Public keys are encoded as the X and Y coordinates each one padded to 32 bytes and signatures as
+	the r and s numbers each one padded to 32 bytes. The old encoding appended the big-endian bytes
+	without padding, so when a number started with zero bytes the split point was not the middle
+	anymore. Keys and signatures in that legacy format are still accepted by trying every split point.
+*/
+const (
+	coordinateLength = 32
+	PublicKeyLength  = 2 * coordinateLength
+	SignatureLength  = 2 * coordinateLength
+)
+
+type derSignature struct {
+	R, S *big.Int
+}
+
+func EncodePublicKey(pub ecdsa.PublicKey) []byte {
+	encoded := make([]byte, PublicKeyLength)
+	pub.X.FillBytes(encoded[:coordinateLength])
+	pub.Y.FillBytes(encoded[coordinateLength:])
+
+	return encoded
+}
+
+/*
+	Besides our own encoding we accept SEC1 public keys, compressed (33 bytes starting by 0x02 or 0x03)
+	and uncompressed (65 bytes starting by 0x04). Shorter keys are legacy keys, the right split is the
+	one that gives us a point on the curve
+*/
+func ParsePublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+
+	switch {
+	case len(data) == PublicKeyLength:
+		return newPublicKey(curve, data[:coordinateLength], data[coordinateLength:])
+	case len(data) == 33 && (data[0] == 0x02 || data[0] == 0x03):
+		x, y := elliptic.UnmarshalCompressed(curve, data)
+		if x == nil {
+			return nil, errors.New("Invalid compressed public key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case len(data) == PublicKeyLength+1 && data[0] == 0x04:
+		return newPublicKey(curve, data[1:coordinateLength+1], data[coordinateLength+1:])
+	case len(data) > 0 && len(data) < PublicKeyLength:
+		for xLen := len(data) - coordinateLength; xLen <= coordinateLength; xLen++ {
+			if xLen < 1 {
+				continue
+			}
+			if pub, err := newPublicKey(curve, data[:xLen], data[xLen:]); err == nil {
+				return pub, nil
+			}
+		}
+	}
+
+	return nil, errors.New("Invalid public key")
+}
+
+func newPublicKey(curve elliptic.Curve, x, y []byte) (*ecdsa.PublicKey, error) {
+	pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("Public key is not on the curve")
+	}
+
+	return pub, nil
+}
+
+/*
+	Both (r, s) and (r, N-s) are valid ECDSA signatures for the same data, so anyone could change
+	the signature of a transaction. We always pick the lowest s, and verifyECDSA refuses a high s in
+	the fixed-width and DER encodings, so those signatures can't be changed anymore
+*/
+func Sign(privKey ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	halfOrder := new(big.Int).Rsh(privKey.Curve.Params().N, 1)
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(privKey.Curve.Params().N, s)
+	}
+
+	signature := make([]byte, SignatureLength)
+	r.FillBytes(signature[:coordinateLength])
+	s.FillBytes(signature[coordinateLength:])
+
+	return signature, nil
+}
+
+// Verifies the signature with the scheme of the key type
+func Verify(keyType KeyType, pubKey, digest, signature []byte) bool {
+	if keyType == Ed25519 {
+		if len(pubKey) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(pubKey), digest, signature)
+	}
+
+	return verifyECDSA(pubKey, digest, signature)
+}
+
+/*
+	Verifies 64 bytes r||s signatures, DER signatures and legacy signatures. The 64 bytes and DER
+	ones must have a low s, else the same signature could be sent again with N-s in either of them.
+	Legacy signatures were made before it was required and still verify
+*/
+func verifyECDSA(pubKey, digest, signature []byte) bool {
+	pub, err := ParsePublicKey(pubKey)
+	if err != nil {
+		return false
+	}
+
+	if len(signature) == SignatureLength {
+		r := new(big.Int).SetBytes(signature[:coordinateLength])
+		s := new(big.Int).SetBytes(signature[coordinateLength:])
+		return isLowS(pub, s) && ecdsa.Verify(pub, digest, r, s)
+	}
+
+	if r, s, ok := parseDERSignature(signature); ok {
+		if !isLowS(pub, s) {
+			return false
+		}
+		if ecdsa.Verify(pub, digest, r, s) {
+			return true
+		}
+	}
+
+	if len(signature) > 0 && len(signature) < SignatureLength {
+		for rLen := len(signature) - coordinateLength; rLen <= coordinateLength; rLen++ {
+			if rLen < 1 {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:rLen])
+			s := new(big.Int).SetBytes(signature[rLen:])
+			if ecdsa.Verify(pub, digest, r, s) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func isLowS(pub *ecdsa.PublicKey, s *big.Int) bool {
+	halfOrder := new(big.Int).Rsh(pub.Curve.Params().N, 1)
+
+	return s.Cmp(halfOrder) <= 0
+}
+
+func parseDERSignature(signature []byte) (*big.Int, *big.Int, bool) {
+	if len(signature) < 8 || signature[0] != 0x30 || int(signature[1]) != len(signature)-2 {
+		return nil, nil, false
+	}
+
+	var sig derSignature
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil || len(rest) != 0 || sig.R == nil || sig.S == nil {
+		return nil, nil, false
+	}
+
+	return sig.R, sig.S, true
+}
@@ -3,17 +3,32 @@ package wallet
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"log"
+	"errors"
+	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
 	checksumLength = 4
-	version        = byte(0x00) // Hexadecimal representatin of 0
+)
+
+var (
+	ErrInvalidAddress = errors.New("Address is not valid")
+	ErrWalletNotFound = errors.New("Wallet not found")
+)
+
+// The key type of a wallet is also the version byte of its addresses
+type KeyType byte
+
+const (
+	P256    KeyType = 0x00 // Hexadecimal representatin of 0
+	Ed25519 KeyType = 0x01
 )
 
 /*
@@ -27,16 +42,23 @@ const (
 	ECDSA (Elliptic Curve Digital Signature Algorithm) is a Digital Signature Algorithm (DSA) which uses
 	keys derived from elliptic curve cryptography (ECC). It is a particularly efficient equation based on
 	public key cryptography (PKC). Thanks to ECDSA we can generate up to 10^77 different keys
+
+	-----------------------------------------------------------------------------------------------------
+
+	Ed25519 is an EdDSA signature scheme over Curve25519, it is faster than ECDSA and its keys and
+	signatures are smaller. New wallets can pick it while P-256 wallets keep working
 */
 type Wallet struct {
-	PrivateKey ecdsa.PrivateKey
-	PublicKey  []byte
+	PrivateKey   ecdsa.PrivateKey
+	PublicKey    []byte
+	Type         KeyType
+	EdPrivateKey ed25519.PrivateKey
 }
 
 func (wallet Wallet) Address() []byte {
 	pubKeyHashed := PublicKeyHash(wallet.PublicKey)
 
-	versionedHash := append([]byte{version}, pubKeyHashed...)
+	versionedHash := append([]byte{byte(wallet.Type)}, pubKeyHashed...)
 	checksum := Checksum(versionedHash)
 
 	fullHash := append(versionedHash, checksum...)
@@ -45,39 +67,84 @@ func (wallet Wallet) Address() []byte {
 	return address
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256() // Output = 256 bytes
 
 	private, err := ecdsa.GenerateKey(curve, rand.Reader) // Generates the private key with the curve and a random number generator
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
 
 	/*
 		For creating the public key we use the concept of the eliptic curve multiplication by  picking
 		values in the eliptic curve at random and we take that X and Y values, we convert them into
-		bytes and append them together
+		bytes padded to 32 bytes and append them together
 	*/
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, pub
+	pub := EncodePublicKey(private.PublicKey)
+	return *private, pub, nil
+
+}
+
+func NewEd25519KeyPair() (ed25519.PrivateKey, []byte, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return private, public, nil
+}
+
+func MakeWallet(keyType KeyType) (*Wallet, error) {
+	if keyType == Ed25519 {
+		private, public, err := NewEd25519KeyPair()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Wallet{ecdsa.PrivateKey{}, public, Ed25519, private}, nil
+	}
+
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wallet{private, public, P256, nil}, nil
 
 }
 
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
+func ParseKeyType(name string) (KeyType, error) {
+	switch strings.ToLower(name) {
+	case "p256", "ecdsa":
+		return P256, nil
+	case "ed25519":
+		return Ed25519, nil
+	}
 
-	return &Wallet{private, public}
+	return P256, fmt.Errorf("Unknown key type %s", name)
+}
 
+func (keyType KeyType) String() string {
+	if keyType == Ed25519 {
+		return "ed25519"
+	}
+	return "p256"
+}
+
+// Signs the digest with the private key of the wallet type
+func (wallet Wallet) Sign(digest []byte) ([]byte, error) {
+	if wallet.Type == Ed25519 {
+		return ed25519.Sign(wallet.EdPrivateKey, digest), nil
+	}
+
+	return Sign(wallet.PrivateKey, digest)
 }
 
 func PublicKeyHash(pubKey []byte) []byte {
 	pubHash := sha256.Sum256(pubKey)
 
-	hasher := ripemd160.New()          // Create a ripemd husher
-	_, err := hasher.Write(pubHash[:]) // Write the public key hashed into the hasher
-	if err != nil {
-		log.Panic(err)
-	}
+	hasher := ripemd160.New() // Create a ripemd husher
+	hasher.Write(pubHash[:])  // Write the public key hashed into the hasher, a hash never returns an error
 
 	publicRipMD := hasher.Sum(nil) // Hash in ripemd the public key already hashed in sha256
 
@@ -97,11 +164,32 @@ func Checksum(pubKeyHashed []byte) []byte {
 	key hash back through the checksum function to create a new checksum so we'll compare the actual checksum with the target checksum
 */
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
+	pubKeyHash, err := Base58Decode([]byte(address))
+	if err != nil || len(pubKeyHash) <= 1+checksumLength {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
 	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
 
+	if KeyType(version) != P256 && KeyType(version) != Ed25519 {
+		return false
+	}
+
 	return bytes.Compare(actualChecksum, targetChecksum) == 0
 }
+
+// Returns the key type and the public key hash locked by a valid address
+func DecodeAddress(address string) (KeyType, []byte, error) {
+	if !ValidateAddress(address) {
+		return P256, nil, ErrInvalidAddress
+	}
+
+	fullHash, err := Base58Decode([]byte(address))
+	if err != nil {
+		return P256, nil, err
+	}
+
+	return KeyType(fullHash[0]), fullHash[1 : len(fullHash)-checksumLength], nil
+}
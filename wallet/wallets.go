@@ -2,20 +2,35 @@ package wallet
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/big"
 	"os"
-)
 
-const walletFile = "./tmp/wallets_%s.data" // %s is used for multiple wallets differencate by ids
+	"github.com/blockchain-app-go/datadir"
+)
 
 type Wallets struct {
 	Wallets map[string]*Wallet
 }
 
+/*
+	Wallets are stored with the raw bytes of their private keys and the type tells us how to rebuild
+	them. Files written before key types existed stored the ecdsa keys directly and are still loaded
+*/
+type storedWallet struct {
+	Type       KeyType
+	PrivateKey []byte
+	PublicKey  []byte
+}
+
+type storedWallets struct {
+	Wallets map[string]storedWallet
+}
+
 func CreateWallets(nodeId string) (*Wallets, error) {
 	wallets := Wallets{}
 
@@ -26,13 +41,16 @@ func CreateWallets(nodeId string) (*Wallets, error) {
 	return &wallets, err
 }
 
-func (wallets *Wallets) AddWallet() string {
-	wallet := MakeWallet()
+func (wallets *Wallets) AddWallet(keyType KeyType) (string, error) {
+	wallet, err := MakeWallet(keyType)
+	if err != nil {
+		return "", err
+	}
 	address := fmt.Sprintf("%s", wallet.Address())
 
 	wallets.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 func (wallets *Wallets) GetAllAddresses() []string {
@@ -45,27 +63,58 @@ func (wallets *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func (wallets Wallets) GetWallet(address string) Wallet {
-	return *wallets.Wallets[address]
+func (wallets Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		return Wallet{}, ErrWalletNotFound
+	}
+
+	return *wallet, nil
 }
 
 func (wallets *Wallets) LoadFile(nodeId string) error {
-	walletFile := fmt.Sprintf(walletFile, nodeId)
+	walletFile := datadir.WalletsFile(nodeId)
 
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
 
-	var ws Wallets
+	var stored storedWallets
 
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
 		return err
 	}
 
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&stored); err != nil {
+		return wallets.loadLegacyFile(fileContent)
+	}
+
+	for address, sw := range stored.Wallets {
+		wallet := Wallet{PublicKey: sw.PublicKey, Type: sw.Type}
+
+		if sw.Type == Ed25519 {
+			wallet.EdPrivateKey = ed25519.PrivateKey(sw.PrivateKey)
+		} else {
+			curve := elliptic.P256()
+			wallet.PrivateKey.Curve = curve
+			wallet.PrivateKey.D = new(big.Int).SetBytes(sw.PrivateKey)
+			wallet.PrivateKey.X, wallet.PrivateKey.Y = curve.ScalarBaseMult(sw.PrivateKey)
+		}
+
+		wallets.Wallets[address] = &wallet
+	}
+
+	return nil
+}
+
+func (wallets *Wallets) loadLegacyFile(fileContent []byte) error {
+	var ws Wallets
+
 	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&ws)
+	err := decoder.Decode(&ws)
 	if err != nil {
 		return err
 	}
@@ -75,21 +124,29 @@ func (wallets *Wallets) LoadFile(nodeId string) error {
 	return nil
 }
 
-func (wallets *Wallets) SaveFile(nodeId string) {
+func (wallets *Wallets) SaveFile(nodeId string) error {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeId)
 
-	gob.Register(elliptic.P256()) // It is used to encode the buffer into the file
+	stored := storedWallets{make(map[string]storedWallet)}
+	for address, wallet := range wallets.Wallets {
+		sw := storedWallet{wallet.Type, nil, wallet.PublicKey}
+		if wallet.Type == Ed25519 {
+			sw.PrivateKey = wallet.EdPrivateKey
+		} else {
+			sw.PrivateKey = wallet.PrivateKey.D.FillBytes(make([]byte, coordinateLength))
+		}
+		stored.Wallets[address] = sw
+	}
 
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(wallets)
+	err := encoder.Encode(stored)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644) // 0644 gives read and write perms
-	if err != nil {
-		log.Panic(err)
+	if err := datadir.Create(nodeId); err != nil {
+		return err
 	}
 
+	return ioutil.WriteFile(datadir.WalletsFile(nodeId), content.Bytes(), 0644) // 0644 gives read and write perms
 }